@@ -0,0 +1,80 @@
+// Command typeinst generates instantiations of generic types, see github.com/dlepex/typeinst
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dlepex/typeinst"
+)
+
+func main() {
+	var opts typeinst.Options
+	flag.StringVar(&opts.File, "file", os.Getenv("GOFILE"), "file with dsl-struct or manifest (.json) (default is $GOFILE)")
+	flag.StringVar(&opts.StructName, "struct", typeinst.DefaultStructName, "dsl-struct name (prefix)")
+	flag.StringVar(&opts.Output, "o", "", "generated file (default is <file><suffix>.go)")
+	flag.StringVar(&opts.Suffix, "suffix", typeinst.FileSuffix, "generated file suffix")
+	flag.StringVar(&opts.PkgName, "pkg", "", "generated package name (default is the package of dsl-struct)")
+	flag.BoolVar(&opts.Check, "check", false, "check that generated file is up to date, print diff and exit with non-zero code otherwise")
+	flag.BoolVar(&opts.Verify, "verify", true, "type-check generated code together with the target package before writing it")
+	flag.BoolVar(&opts.AllFiles, "all", false, "process dsl-structs of all files in the package of -file")
+	flag.BoolVar(&opts.Tests, "tests", false, "instantiate tests of generic packages into <file><suffix>_test.go")
+	flag.BoolVar(&opts.Copy, "copy", false, "copy non-generic code used by generic types into generated file (under mangled names)")
+	opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	opts.Diff = os.Stdout
+	args := os.Args[1:]
+	migrate := len(args) > 0 && args[0] == "migrate"
+	if migrate {
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args) // flag.ExitOnError
+	if migrate {
+		fileArg(&opts)
+		fatalIfErr(typeinst.Migrate(opts))
+		return
+	}
+	if ext := filepath.Ext(flag.Arg(0)); flag.NArg() > 0 && ext != ".go" && ext != ".json" && ext != ".yaml" && ext != ".yml" {
+		// package patterns e.g. ./... (yaml file is rejected by RunOptions)
+		fatalIfErr(typeinst.RunPackages(opts, flag.Args()...))
+		return
+	}
+	fileArg(&opts)
+	opts.Logger.Printf("$GOPATH = %v, $GOFILE = %v", os.Getenv("GOPATH"), opts.File)
+	fatalIfErr(typeinst.RunOptions(opts))
+}
+
+// fileArg sets opts.File to the positional [file] argument, which overrides $GOFILE,
+// but it conflicts with explicit -file flag
+func fileArg(opts *typeinst.Options) {
+	if flag.NArg() > 1 {
+		usage()
+	}
+	if flag.NArg() == 1 {
+		explicit := false
+		flag.Visit(func(f *flag.Flag) {
+			explicit = explicit || f.Name == "file"
+		})
+		if explicit && opts.File != flag.Arg(0) {
+			fatalIfErr(fmt.Errorf("conflicting files: -file %s and argument %s", opts.File, flag.Arg(0)))
+		}
+		opts.File = flag.Arg(0)
+	}
+	if opts.File == "" {
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: typeinst [flags] [file]\n       typeinst [flags] packages...\n       typeinst migrate [flags] [file]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fatalIfErr(err error) {
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package typeinst
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// PosError is an error with source position, it is printed in the standard "file:line:col: msg" format
+type PosError struct {
+	Pos token.Position
+	Err error
+}
+
+func (e *PosError) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Err.Error()
+	}
+	return e.Pos.String() + ": " + e.Err.Error()
+}
+
+// errorAt attaches pos to err, unless err (or its elements in case of ErrorList) already has one
+func errorAt(pos token.Position, err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *PosError:
+		return e
+	case ErrorList:
+		el := make(ErrorList, 0, len(e))
+		for _, x := range e {
+			el = append(el, errorAt(pos, x))
+		}
+		return el
+	}
+	return &PosError{pos, err}
+}
+
+// errorfAt is fmt.Errorf with position
+func errorfAt(pos token.Position, format string, a ...interface{}) error {
+	return &PosError{pos, fmt.Errorf(format, a...)}
+}
+
+// ErrorList collects diagnostics, so that all problems are reported at once instead of stopping at the first one.
+// Truly fatal conditions are still reported via bpan.
+type ErrorList []error
+
+// Add appends err (if any), repeated errors are ignored
+func (l *ErrorList) Add(err error) {
+	if err == nil {
+		return
+	}
+	if el, ok := err.(ErrorList); ok {
+		for _, e := range el {
+			l.Add(e)
+		}
+		return
+	}
+	for _, e := range *l {
+		if e.Error() == err.Error() {
+			return
+		}
+	}
+	*l = append(*l, err)
+}
+
+// Addf appends formatted error
+func (l *ErrorList) Addf(format string, a ...interface{}) {
+	l.Add(fmt.Errorf(format, a...))
+}
+
+// AddAt appends err (if any) with position pos
+func (l *ErrorList) AddAt(pos token.Position, err error) {
+	l.Add(errorAt(pos, err))
+}
+
+// CatchAt calls f and adds bounded panic (if any) with position pos to the list, it returns false if f has panicked.
+func (l *ErrorList) CatchAt(pos token.Position, f func()) bool {
+	var err error
+	func() {
+		defer bpan.RecoverTo(&err)
+		f()
+	}()
+	l.AddAt(pos, err)
+	return err == nil
+}
+
+// Err returns nil for empty list, otherwise the list itself
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	msgs := make([]string, 0, len(l)+1)
+	msgs = append(msgs, fmt.Sprintf("%d errors:", len(l)))
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
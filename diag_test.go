@@ -0,0 +1,60 @@
+package typeinst
+
+import (
+	"errors"
+	"go/token"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorList(t *testing.T) {
+	var errs ErrorList
+	assert.NoError(t, errs.Err())
+	errs.Add(nil)
+	errs.Add(errors.New("e1"))
+	errs.Add(errors.New("e1"))
+	errs.Add(ErrorList{errors.New("e2"), errors.New("e3")})
+	assert.Len(t, errs, 3)
+	assert.Equal(t, "3 errors:\ne1\ne2\ne3", errs.Err().Error())
+	pos := token.Position{Filename: "a.go", Line: 2, Column: 3}
+	assert.False(t, errs.CatchAt(pos, func() { bpan.Panicf("e4") }))
+	assert.True(t, errs.CatchAt(pos, func() {}))
+	assert.Len(t, errs, 4)
+	assert.Equal(t, "a.go:2:3: e4", errs[3].Error())
+	errs.AddAt(pos, errorfAt(token.Position{Filename: "b.go", Line: 1, Column: 1}, "e5"))
+	assert.Equal(t, "b.go:1:1: e5", errs[4].Error())
+}
+
+func TestParseDSLErrors(t *testing.T) {
+	dsl, err := ParseDSL("testdata/bad/bad.go", "")
+	assert.NotNil(t, dsl)
+	assert.Len(t, dsl.Items, 1)
+	assert.Equal(t, "Good", dsl.Items[0].InstName)
+	errs, ok := err.(ErrorList)
+	assert.True(t, ok)
+	assert.Len(t, errs, 5)
+}
+
+func TestParseDSLErrorPositions(t *testing.T) {
+	_, err := ParseDSL("testdata/bad/bad.go", "")
+	errs := err.(ErrorList)
+	for i, line := range []string{"8:11", "9:11", "10:34", "11:2", "13:23"} {
+		assert.Contains(t, errs[i].Error(), "testdata/bad/bad.go:"+line+": ")
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	dsl, err := ParseManifest("testdata/bad/manifest.json")
+	assert.NotNil(t, dsl)
+	assert.Len(t, dsl.Items, 1)
+	assert.Equal(t, "Ok", dsl.Items[0].InstName)
+	errs, ok := err.(ErrorList)
+	assert.True(t, ok)
+	assert.Len(t, errs, 3)
+	for i, line := range []string{"5:3", "6:3", "7:3"} {
+		assert.Contains(t, errs[i].Error(), "testdata/bad/manifest.json:"+line+": ")
+	}
+	_, err = ParseManifest("testdata/bad/bad.go")
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package typeinst
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	b := []byte("a\nb\nc\nd\nE\nf\ng\nh\ni\nj\nk\n")
+	assert.Equal(t, "", unifiedDiff("a", "b", a, a))
+	assert.Equal(t, `--- a
++++ b
+@@ -2,9 +2,10 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+ i
+ j
++k
+`, unifiedDiff("a", "b", a, b))
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+x\n", unifiedDiff("a", "b", nil, []byte("x\n")))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-x\n", unifiedDiff("a", "b", []byte("x\n"), nil))
+	// difference in trailing newline only
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,2 +1,2 @@\n x\n-y\n+y\n\\ No newline at end of file\n",
+		unifiedDiff("a", "b", []byte("x\ny\n"), []byte("x\ny")))
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+\n", unifiedDiff("a", "b", nil, []byte("\n")))
+}
+
+func TestDiffLines(t *testing.T) {
+	apply := func(ops []diffOp) (a, b []string) {
+		for _, op := range ops {
+			if op.kind != '+' {
+				a = append(a, op.line)
+			}
+			if op.kind != '-' {
+				b = append(b, op.line)
+			}
+		}
+		return
+	}
+	cases := [][2]string{
+		{"", ""}, {"abc", ""}, {"", "abc"}, {"abcabba", "cbabac"}, {"xaxbx", "ayb"}, {"abcd", "dcba"},
+	}
+	for _, c := range cases {
+		a, b := strings.Split(c[0], ""), strings.Split(c[1], "")
+		ops := diffLines(a, b)
+		ea, eb := apply(ops)
+		assert.Equal(t, len(a), len(ea), c)
+		assert.Equal(t, len(b), len(eb), c)
+		assert.Equal(t, strings.Join(a, ""), strings.Join(ea, ""), c)
+		assert.Equal(t, strings.Join(b, ""), strings.Join(eb, ""), c)
+	}
+	// the edit script is the shortest one
+	edits := 0
+	for _, op := range diffLines(strings.Split("abcabba", ""), strings.Split("cbabac", "")) {
+		if op.kind != ' ' {
+			edits++
+		}
+	}
+	assert.Equal(t, 5, edits)
+	// big files which differ in a single line
+	var big, big2 bytes.Buffer
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&big, "line %d\n", i)
+		if i == 25000 {
+			big2.WriteString("changed\n")
+		} else {
+			fmt.Fprintf(&big2, "line %d\n", i)
+		}
+	}
+	assert.Equal(t, `--- a
++++ b
+@@ -24998,7 +24998,7 @@
+ line 24997
+ line 24998
+ line 24999
+-line 25000
++changed
+ line 25001
+ line 25002
+ line 25003
+`, unifiedDiff("a", "b", big.Bytes(), big2.Bytes()))
+}
@@ -1,127 +1,188 @@
-package main
+package typeinst
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"path/filepath"
 	"reflect"
 	"strings"
+
+	"github.com/dlepex/typeinst/internal/sets"
 )
 
 type (
 	// DSL - dsl-struct description
 	DSL struct {
 		Imports
-		Items   []*DSLItem
-		PkgName string
+		Items      []*DSLItem
+		PkgName    string
+		Filename   string // file of dsl-struct
+		StructName string
+		Output     string   // output file set by "//typeinst: output <file>" comment, relative to dsl file dir
+		Warnings   []string // e.g. ignored comments, they are logged by the tool
 	}
 	// DSLItem corresponds to the field of dsl-struct
 	DSLItem struct {
 		InstName     string
 		GenericTypes []PkgTypePair
 		TypeArgs     map[string]string
+		Pos          token.Position // position of dsl-struct field
 	}
 	// PkgTypePair tuple of type and its package
 	PkgTypePair struct {
 		PkgName string
 		Type    string
+		Args    []string // type arguments bound to typevars by position e.g. set.Set[string], see PkgDesc.bindTypeArgs
 	}
 )
 
-const defaultStructName = "_typeinst"
+// DefaultStructName is the default name (prefix) of dsl-structs
+const DefaultStructName = "_typeinst"
+
+// ErrDSLNotFound is returned if file has no dsl-struct
+var ErrDSLNotFound = errors.New("declaration of dsl-struct not found")
+
+// ParseDSL parses and rertrieves the first dsl-struct of the file, see ParseDSLs.
+func ParseDSL(filename, structName string) (*DSL, error) {
+	dsls, err := ParseDSLs(filename, structName)
+	if len(dsls) == 0 {
+		return nil, err
+	}
+	return dsls[0], err
+}
 
-// ParseDSL parses and rertrieves dsl-struct
-func ParseDSL(filename, structName string) (dsl *DSL, err error) {
+// ParseDSLs parses and rertrieves all dsl-structs of the file (i.e. structs whose names start with structName).
+// In case of bad dsl-struct fields the valid part of dsl is returned together with ErrorList describing all bad fields.
+func ParseDSLs(filename, structName string) (dsls []*DSL, err error) {
 	defer bpan.RecoverTo(&err)
 	if structName == "" {
-		structName = defaultStructName
+		structName = DefaultStructName
 	}
 	fset := token.NewFileSet()
 	f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
-	dsl = &DSL{
-		PkgName: f.Name.Name,
-	}
+	var dsl *DSL
 	imports := Imports{}
+	var errs ErrorList
 
 	for _, spec := range f.Imports {
 		if err := imports.AddSpec(spec); err != nil {
-			return nil, fmt.Errorf("bad imports: %v", err)
+			errs.Add(errorfAt(fset.Position(spec.Pos()), "bad imports: %v", err))
 		}
 	}
 
 	stringer := astStringer{}
+	panicAt := func(n ast.Node, format string, a ...interface{}) {
+		bpan.Check(errorfAt(fset.Position(n.Pos()), format, a...))
+	}
 
-	parseFunc := func(it *DSLItem, t *ast.FuncType) {
+	// parseResults parses generic types, typevars are bound either by dsl-func params, or by type arguments
+	// of generic types (e.g. set.Set[string]), params are nil in the latter case.
+	parseResults := func(it *DSLItem, params *ast.FieldList, results []ast.Expr) {
 
-		typeVarsPkgs := NewStrSet()
+		typeVarsPkgs := sets.NewStrSet()
 		walker := pkgNameWalker(typeVarsPkgs)
 		estr := func(s string) string {
 			return s + " [in dsl-struct field: " + it.InstName + "]"
 		}
-		if t.Params == nil || len(t.Params.List) == 0 {
-			bpan.Panicf(estr("dsl-func has no arguments i.e. typevar substitutions"))
-		}
-		if t.Results == nil || len(t.Results.List) == 0 {
-			bpan.Panicf(estr("dsl-func has no result i.e. generic type"))
+		if params != nil {
+			for _, field := range params.List {
+				if len(field.Names) != 1 {
+					panicAt(field, estr("typevar param in func requires name"))
+				}
+				typeVar := fieldName(field)
+				ast.Walk(walker, field.Type)
+				it.TypeArgs[typeVar] = stringer.ToString(field.Type)
+			}
 		}
-		for _, field := range t.Params.List {
-			typeVar := fieldName(field)
-			if typeVar == "" {
-				bpan.Panicf(estr("typevar param in func requires name"))
+
+		qtset := sets.NewStrSet()
+		for _, t := range results {
+			pair, args := parseGenericTypeExpr(t)
+			if (len(it.TypeArgs) != 0) == (len(args) != 0) {
+				if len(args) == 0 {
+					panicAt(t, estr("dsl-func has no arguments i.e. typevar substitutions"))
+				}
+				panicAt(t, estr("typevars are bound either by dsl-func params or by type arguments, not both"))
+			}
+			for _, a := range args {
+				ast.Walk(walker, a)
+				pair.Args = append(pair.Args, stringer.ToString(a))
+			}
+			qt := pair.qualifiedType()
+			if qtset.Contains(qt) {
+				panicAt(t, estr("merging repeated generic type: %v"), qt)
+			}
+			qtset.Add(qt)
+			if pair.PkgName != "" {
+				pair.PkgName = imports.requireNamed(pair.PkgName)
+			} else {
+				pair.PkgName = localPkgPath
 			}
-			ast.Walk(walker, field.Type)
-			it.TypeArgs[typeVar] = stringer.ToString(field.Type)
+			it.GenericTypes = append(it.GenericTypes, pair)
 		}
 
 		for pkgname := range typeVarsPkgs {
 			bpan.Check(dsl.Imports.Add(pkgname, imports.requireNamed(pkgname)))
 		}
+	}
 
-		qtset := NewStrSet()
+	parseFunc := func(it *DSLItem, t *ast.FuncType) {
+		if t.Results == nil || len(t.Results.List) == 0 {
+			panicAt(t, "dsl-func has no result i.e. generic type [in dsl-struct field: %s]", it.InstName)
+		}
+		var results []ast.Expr
 		for _, field := range t.Results.List {
 			if len(field.Names) > 0 {
-				bpan.Panicf(estr("dsl-func result cannot have field names"))
-			}
-			pair := parseGenericTypeExpr(field.Type)
-			if pair.PkgName == "" {
-				bpan.Panicf(estr("generic type cannot be local, it must be imported from another package"))
+				panicAt(field, "dsl-func result cannot have field names [in dsl-struct field: %s]", it.InstName)
 			}
-			qt := pair.qualifiedType()
-			if qtset.Contains(qt) {
-				bpan.Panicf(estr("merging repeated generic type: %v"), qt)
-			}
-			qtset.Add(qt)
-			pair.PkgName = imports.requireNamed(pair.PkgName)
-			it.GenericTypes = append(it.GenericTypes, pair)
+			results = append(results, field.Type)
+		}
+		var params *ast.FieldList
+		if t.Params != nil && len(t.Params.List) != 0 {
+			params = t.Params
+		} else if _, args := parseGenericTypeExpr(results[0]); len(args) == 0 {
+			panicAt(t, "dsl-func has no arguments i.e. typevar substitutions [in dsl-struct field: %s]", it.InstName)
 		}
+		parseResults(it, params, results)
 	}
 
 	parseStruct := func(ts *ast.TypeSpec) {
 		expr, ok := ts.Type.(*ast.StructType)
 		if !ok {
-			bpan.Panicf("struct type expected")
+			panicAt(ts, "struct type expected")
 		}
 		if expr.Fields == nil || len(expr.Fields.List) == 0 {
-			bpan.Panicf("empty struct")
+			panicAt(ts, "empty struct")
 		}
 		for _, field := range expr.Fields.List {
 			it := &DSLItem{
-				InstName: fieldName(field),
 				TypeArgs: make(map[string]string),
+				Pos:      fset.Position(field.Pos()),
 			}
-			ft, ok := field.Type.(*ast.FuncType)
-			if !ok {
-				bpan.Panicf("struct fields must have func types, e.g: `func(K int, V string) MyMap`, found: field: %s type: %v ",
-					it.InstName, reflect.TypeOf(ts.Type))
+			ok := errs.CatchAt(it.Pos, func() {
+				it.InstName = fieldName(field)
+				switch ft := field.Type.(type) {
+				case *ast.FuncType:
+					parseFunc(it, ft)
+				case *ast.IndexExpr, *ast.IndexListExpr:
+					// generic type with type arguments e.g. `FloatTreeMap maps.TreeMap[float64, float64]`
+					parseResults(it, nil, []ast.Expr{ft})
+				default:
+					bpan.Panicf("struct fields must have func types, e.g: `func(K int, V string) MyMap` or `func() MyMap[int, string]`, found: field: %s type: %v ",
+						it.InstName, reflect.TypeOf(field.Type))
+				}
+			})
+			if ok {
+				dsl.Items = append(dsl.Items, it)
 			}
-			parseFunc(it, ft)
-			dsl.Items = append(dsl.Items, it)
 		}
 	}
 	for _, decl := range f.Decls {
@@ -132,14 +193,87 @@ func ParseDSL(filename, structName string) (dsl *DSL, err error) {
 					ts := spec.(*ast.TypeSpec)
 					name := ts.Name.Name
 					if strings.HasPrefix(name, structName) {
-						parseStruct(ts)
-						return
+						dsl = &DSL{
+							PkgName:    f.Name.Name,
+							Filename:   filename,
+							StructName: name,
+						}
+						ok := errs.CatchAt(fset.Position(ts.Pos()), func() {
+							for _, cg := range []*ast.CommentGroup{decl.Doc, ts.Doc, ts.Comment} {
+								dsl.parseSpecialComments(cg)
+							}
+							parseStruct(ts)
+						})
+						if ok {
+							dsls = append(dsls, dsl)
+						}
 					}
 				}
 			}
 		}
 	}
-	return nil, fmt.Errorf("delaration of dsl struct not found: %s", structName)
+	if len(dsls) == 0 && len(errs) == 0 {
+		return nil, fmt.Errorf("%s: %w: %s", filename, ErrDSLNotFound, structName)
+	}
+	return dsls, errs.Err()
+}
+
+func (dsl *DSL) parseSpecialComments(cg *ast.CommentGroup) {
+	if cg == nil {
+		return
+	}
+	for _, c := range cg.List {
+		if !strings.HasPrefix(c.Text, commentPrefix) {
+			continue
+		}
+		args := strings.Fields(strings.TrimPrefix(c.Text, commentPrefix))
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "output":
+			if len(args) != 2 || !strings.HasSuffix(args[1], ".go") {
+				bpan.Panicf("'%s output' comment requires single .go file argument", commentPrefix)
+			}
+			dsl.Output = args[1]
+		default:
+			dsl.Warnings = append(dsl.Warnings, fmt.Sprintf("%s: ignoring illegal '%s'-comment unknown verb: %s", dsl.Filename, commentPrefix, args[0]))
+		}
+	}
+}
+
+// genericPackages returns (unquoted) paths of imported generic packages used by dsl
+func (dsl *DSL) genericPackages() []string {
+	paths := sets.NewStrSet()
+	for _, it := range dsl.Items {
+		for _, g := range it.GenericTypes {
+			if g.PkgName != localPkgPath {
+				paths.Add(unquote(g.PkgName))
+			}
+		}
+	}
+	return sortedStrs(paths)
+}
+
+// OutputFile returns the name of generated file for dsl-struct:
+//   - the file set by "//typeinst: output" comment (or by "output" of manifest)
+//   - <manifest name><suffix>.go for manifest e.g. typeinst_ti.go for typeinst.json
+//   - <file><suffix>.go for the struct named exactly as default prefix (_typeinst)
+//   - <lowercased struct name without prefix><suffix>.go e.g. collections_ti.go for _typeinstCollections
+func (dsl *DSL) OutputFile(structPrefix, suffix string) (string, error) {
+	dir := filepath.Dir(dsl.Filename)
+	if dsl.Output != "" {
+		return filepath.Join(dir, dsl.Output), nil
+	}
+	if isManifest(dsl.Filename) {
+		base := filepath.Base(dsl.Filename)
+		return filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+suffix+".go"), nil
+	}
+	rest := strings.Trim(strings.TrimPrefix(dsl.StructName, structPrefix), "_")
+	if rest == "" {
+		return implFilename(dsl.Filename, suffix)
+	}
+	return filepath.Join(dir, strings.ToLower(rest)+suffix+".go"), nil
 }
 
 func fieldName(field *ast.Field) string {
@@ -173,25 +307,33 @@ func (w pkgNameWalker) Visit(n ast.Node) ast.Visitor {
 	case *ast.SelectorExpr:
 		switch n := n.X.(type) {
 		case *ast.Ident:
-			StrSet(w).Add(n.Name)
+			sets.StrSet(w).Add(n.Name)
 		}
 	}
 	return w
 }
 
-func parseGenericTypeExpr(t ast.Expr) PkgTypePair {
+// parseGenericTypeExpr parses generic type of dsl-struct field, and its type arguments if any (e.g. set.Set[string])
+func parseGenericTypeExpr(t ast.Expr) (PkgTypePair, []ast.Expr) {
+	var args []ast.Expr
+	switch x := t.(type) {
+	case *ast.IndexExpr:
+		t, args = x.X, []ast.Expr{x.Index}
+	case *ast.IndexListExpr:
+		t, args = x.X, x.Indices
+	}
 	switch t := t.(type) {
 	case *ast.Ident:
-		return PkgTypePair{"", t.Name}
+		return PkgTypePair{PkgName: "", Type: t.Name}, args
 	case *ast.SelectorExpr:
 		typ := t.Sel.Name
 		switch t := t.X.(type) {
 		case *ast.Ident:
-			return PkgTypePair{t.Name, typ}
+			return PkgTypePair{PkgName: t.Name, Type: typ}, args
 		}
 	}
 	bpan.Panicf("unexpected type expr for generic type: %v in expr: %v", reflect.TypeOf(t), t)
-	return PkgTypePair{}
+	return PkgTypePair{}, nil
 }
 
 func (p PkgTypePair) qualifiedType() string {
@@ -0,0 +1,187 @@
+package typeinst
+
+import (
+	"go/ast"
+
+	"github.com/dlepex/typeinst/internal/sets"
+)
+
+// Generic package may depend on generic types of imported generic package (e.g. graph.Graph uses set.Set),
+// typevars of the imported package are bound by aliases of importer typevars:
+//
+//	type V = set.E //typeinst: typevar
+//
+// Generic types, ctors and funcs of the imported package used by instantiated types are instantiated
+// in the imported package (of the same Impl) with the type arguments of their importer typevars.
+
+// foreignKey identifies instance of generic type of imported generic package
+type foreignKey struct {
+	imp  string    // import name
+	typ  string    // generic type of imported package
+	args *TypeArgs // type arguments of importer instance
+}
+
+// genericImports returns import names of generic packages whose typevars are bound by typevars of pd
+func (pd *PkgDesc) genericImports() []string {
+	imps := sets.NewStrSet()
+	for tv := range pd.typevars {
+		if a, ok := pd.tvAliases[tv]; ok {
+			imps.Add(a.X.(*ast.Ident).Name)
+		}
+	}
+	return sortedStrs(imps)
+}
+
+// aliasesOf returns typevars aliased to members of imported package q, in declaration order
+func (pd *PkgDesc) aliasesOf(q string) []string {
+	tvs := sets.NewStrSet()
+	for tv := range pd.typevars {
+		if a, ok := pd.tvAliases[tv]; ok && a.X.(*ast.Ident).Name == q {
+			tvs.Add(tv)
+		}
+	}
+	return pd.declOrder(sortedStrs(tvs))
+}
+
+// localTypevar returns typevar of pd which binds typevar (or other member) name of imported package q, or ""
+func (pd *PkgDesc) localTypevar(q, name string) string {
+	for _, tv := range pd.aliasesOf(q) {
+		if pd.tvAliases[tv].Sel.Name == name {
+			return tv
+		}
+	}
+	return ""
+}
+
+// member returns generic type of the package which name refers to: type, ctor (of type) or free standing func
+func (pd *PkgDesc) member(name string) (*TypeDesc, bool) {
+	t, ok := pd.ctors[name]
+	if !ok {
+		t, ok = pd.typeOrFunc(name)
+	}
+	if !ok || t.spec == nil {
+		return nil, false
+	}
+	return t, true
+}
+
+// resolveForeign is resolveRecur for the member of imported package: td depends on the importer typevars
+// bound to the typevars of generic member (typevars left unbound are reported by instForeign)
+func (pd *PkgDesc) resolveForeign(td *TypeDesc, sel *ast.SelectorExpr) {
+	q := sel.X.(*ast.Ident).Name
+	dep, ok := pd.deps[q]
+	if !ok {
+		return
+	}
+	if tv := pd.localTypevar(q, sel.Sel.Name); tv != "" {
+		td.typevars.Add(tv)
+		return
+	}
+	t, ok := dep.member(sel.Sel.Name)
+	if !ok {
+		return
+	}
+	tvs := dep.typevarsOf(t)
+	if len(tvs) == 0 {
+		return
+	}
+	for _, ftv := range tvs {
+		if tv := pd.localTypevar(q, ftv); tv != "" {
+			td.typevars.Add(tv)
+		}
+	}
+	td.foreign = append(td.foreign, sel)
+}
+
+// instForeign instantiates generic members of imported generic packages for each instance of the types which use them,
+// instance with the same type arguments is shared (e.g. the instance of dsl-struct).
+func (pd *PkgDesc) instForeign() error {
+	var errs ErrorList
+	for _, t := range pd.sortedTypes() {
+		if !t.isGeneric() {
+			continue
+		}
+		for _, sel := range t.foreign {
+			q := sel.X.(*ast.Ident).Name
+			dep := pd.deps[q]
+			ft, _ := dep.member(sel.Sel.Name)
+			tvs := dep.typevarsOf(ft)
+			unbound := false
+			for _, ftv := range tvs {
+				if pd.localTypevar(q, ftv) == "" {
+					errs.Add(errorfAt(pd.position(sel), "typevar %s of generic type %s.%s is unbound in package %s (declare typevar: type T = %s.%s)",
+						ftv, q, ft.name(), pd.name, q, ftv))
+					unbound = true
+				}
+			}
+			if unbound {
+				continue
+			}
+			for _, b := range t.instOrder {
+				key := foreignKey{q, ft.name(), b}
+				if _, has := pd.foreignInst[key]; has {
+					continue
+				}
+				typeArgs := make(map[string]string)
+				for _, ftv := range tvs {
+					typeArgs[ftv] = b.Binds[pd.localTypevar(q, ftv)]
+				}
+				instName, err := dep.instDep(ft, typeArgs, MangleDepTypeName(ft.name(), t.name(), t.inst[b]))
+				if err != nil {
+					errs.Add(errorAt(pd.position(sel), err))
+					break
+				}
+				pd.foreignInst[key] = instName
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// instDep instantiates generic type t on behalf of generic type of the importing package,
+// if t is already instantiated with the same type arguments (of its typevars) the existing instance is shared.
+func (pd *PkgDesc) instDep(t *TypeDesc, typeArgs map[string]string, instName string) (string, error) {
+	if err := pd.bindTypevars(typeArgs); err != nil {
+		return "", err
+	}
+	b := pd.targs.of(typeArgs)
+	if name, has := t.inst[b]; has {
+		return name, nil
+	}
+	tvs := sets.NewStrSet()
+	for tv := range typeArgs {
+		tvs.Add(tv)
+	}
+	if name, ok := t.instBoundAs(tvs, b); ok {
+		return name, nil
+	}
+	if err := pd.addInst(t, b, instName); err != nil {
+		return "", err
+	}
+	return instName, nil
+}
+
+// foreignName returns the name which member of imported generic package is printed as in the instance of args,
+// or "" if it is not substituted (then its qualifier is not dropped).
+func (pd *PkgDesc) foreignName(sel *ast.SelectorExpr, args *TypeArgs) string {
+	if args == nil {
+		return ""
+	}
+	q, n := sel.X.(*ast.Ident).Name, sel.Sel.Name
+	if tv := pd.localTypevar(q, n); tv != "" {
+		return args.Binds[tv]
+	}
+	dep := pd.deps[q]
+	if t, ok := dep.ctors[n]; ok {
+		if instName, ok := pd.foreignInst[foreignKey{q, t.name(), args}]; ok {
+			return MangleCtorName(n, t.name(), instName)
+		}
+		return ""
+	}
+	if t, ok := dep.types[n]; ok && t.spec != nil {
+		if instName, ok := pd.foreignInst[foreignKey{q, t.name(), args}]; ok {
+			return t.printedName(instName)
+		}
+	}
+	return ""
+}
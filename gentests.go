@@ -0,0 +1,220 @@
+package typeinst
+
+import (
+	"fmt"
+	"go/ast"
+	"io"
+	"strings"
+
+	pri "github.com/dlepex/typeinst/internal/printer"
+	"github.com/dlepex/typeinst/internal/sets"
+)
+
+// parseTestFile returns free standing funcs of generic package _test.go file, its imports are added to imports.
+// Other declarations of test files are not supported.
+func parseTestFile(f *ast.File, imports *Imports) (funcs []*ast.FuncDecl) {
+	for _, spec := range f.Imports {
+		bpan.Check(imports.AddSpec(spec))
+	}
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+			funcs = append(funcs, fd)
+		}
+	}
+	return
+}
+
+// resolveTests finds the "owner" of each test func i.e. the first generic type (or its ctor) it refers to.
+// Test func is instantiated once per each instance of its owner.
+// Func which depends only on typevars (e.g. helper func eq(a, b T) bool) is instantiated once per distinct binding of its typevars.
+// Funcs which refer to declarations not present in generated code (free standing funcs, not instantiated types) are skipped.
+func (pd *PkgDesc) resolveTests() {
+	pd.testOwner = make(map[string]*TypeDesc)
+	pd.testTypevars = make(map[string]sets.StrSet)
+	var funcs []*ast.FuncDecl
+	for _, f := range pd.testFuncs {
+		var owner *TypeDesc
+		tvs := sets.NewStrSet()
+		missing := ""
+		var reach astWalker = func(p astWalkerParams) {
+			n := p.id.Name
+			if p.kind != ast.Bad || missing != "" {
+				return // test file declarations are resolved by parser, package ones are not
+			}
+			if _, ok := pd.funcs[n]; ok {
+				missing = n
+				return
+			}
+			t, ok := pd.types[n]
+			if !ok {
+				t, ok = pd.ctors[n]
+			}
+			if !ok {
+				return
+			}
+			if t.isTypevar {
+				tvs.Add(n)
+				return
+			}
+			if len(t.inst) == 0 && t.isGeneric() {
+				missing = n
+			} else if owner == nil && t.isGeneric() {
+				owner = t
+			}
+		}
+		ast.Walk(reach, f.Type)
+		ast.Walk(reach, f.Body)
+		if missing != "" {
+			logf(pd.log, "test: skipping %s, it refers to %s which is not generated", f.Name.Name, missing)
+			continue
+		}
+		if owner != nil {
+			pd.testOwner[f.Name.Name] = owner
+		} else if len(tvs) != 0 {
+			pd.testTypevars[f.Name.Name] = tvs
+		}
+		funcs = append(funcs, f)
+	}
+	pd.testFuncs = funcs
+	var mark astWalker = pd.markOccurences
+	for _, f := range pd.testFuncs {
+		ast.Walk(mark, f.Type)
+		ast.Walk(mark, f.Body)
+	}
+}
+
+func (pd *PkgDesc) testRenameFunc(args *TypeArgs) pri.RenameFunc {
+	rename := pd.renameFunc(args)
+	return func(id *ast.Ident) string {
+		if pd.occTests.Contains(id) {
+			if owner, ok := pd.testOwner[id.Name]; ok {
+				if instName, ok := owner.inst[args]; ok {
+					return MangleCtorName(id.Name, owner.name(), instName)
+				}
+			} else if instName, ok := pd.testTypevarInst(id.Name, args); ok {
+				return instName
+			}
+		}
+		return rename(id)
+	}
+}
+
+// testTypevarInst returns the name of the instance of test func n (which depends only on typevars) printed for args:
+// the instances of generic types binding typevars of n the same way share the copy named after the first of them.
+func (pd *PkgDesc) testTypevarInst(n string, args *TypeArgs) (string, bool) {
+	tvs, ok := pd.testTypevars[n]
+	if !ok || args == nil {
+		return "", false
+	}
+	for tv := range tvs {
+		if _, ok := args.Binds[tv]; !ok {
+			return "", false
+		}
+	}
+	for _, t := range pd.sortedTypes() {
+		if !t.isGeneric() {
+			continue
+		}
+		if instName, ok := t.instBoundAs(tvs, args); ok {
+			s, _ := strUpcase(instName)
+			return n + s, true
+		}
+	}
+	return "", false
+}
+
+// printTests prints test funcs: each func depending on generic type is printed for every instance of the type
+// under the mangled name (e.g. TestSet -> TestStrSet), each func depending only on typevars is printed
+// for every distinct binding of them (e.g. eq -> eqStrSet), the other funcs are printed once as is.
+func (pd *PkgDesc) printTests(w io.Writer, printed sets.StrSet) {
+	for _, f := range pd.testFuncs {
+		if _, ok := pd.testTypevars[f.Name.Name]; ok {
+			pd.printTypevarTest(w, f, printed)
+			continue
+		}
+		owner, ok := pd.testOwner[f.Name.Name]
+		if !ok {
+			if !printed.Contains(f.Name.Name) {
+				printed.Add(f.Name.Name)
+				newAstPrinter(w, func(id *ast.Ident) string {
+					if pd.occPkgs.Contains(id) {
+						return pd.impRename[id.Name]
+					}
+					return id.Name
+				}).println(f)
+			}
+			continue
+		}
+		for _, args := range owner.instOrder {
+			fc := *f
+			fc.Name = &ast.Ident{Name: uniqueName(MangleCtorName(f.Name.Name, owner.name(), owner.inst[args]), printed)}
+			pd.newPrinter(w, pd.testRenameFunc(args), args).println(&fc)
+		}
+	}
+}
+
+// printTypevarTest prints test func f which depends only on typevars once per distinct binding of them
+func (pd *PkgDesc) printTypevarTest(w io.Writer, f *ast.FuncDecl, printed sets.StrSet) {
+	seen := sets.NewStrSet()
+	for _, t := range pd.sortedTypes() {
+		if !t.isGeneric() {
+			continue
+		}
+		for _, args := range t.instOrder {
+			n, ok := pd.testTypevarInst(f.Name.Name, args)
+			if !ok || seen.Contains(n) {
+				continue
+			}
+			seen.Add(n)
+			fc := *f
+			fc.Name = &ast.Ident{Name: uniqueName(n, printed)}
+			pd.newPrinter(w, pd.testRenameFunc(args), args).println(&fc)
+		}
+	}
+}
+
+// uniqueName adds numeric suffix to n, if it is already used, the result is added to used
+func uniqueName(n string, used sets.StrSet) string {
+	u := n
+	for i := 2; used.Contains(u); i++ {
+		u = fmt.Sprintf("%s_%d", n, i)
+	}
+	used.Add(u)
+	return u
+}
+
+// TestOutputFile returns the name of generated test file e.g. x_ti_test.go for x_ti.go
+func (im *Impl) TestOutputFile() string {
+	return strings.TrimSuffix(im.outputFile, ".go") + "_test.go"
+}
+
+func (im *Impl) hasTests() bool {
+	for _, pd := range im.pkg {
+		if len(pd.testFuncs) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// TestBytes prints instantiated tests of generic packages, it returns nil if there are no tests.
+func (im *Impl) TestBytes() ([]byte, error) {
+	if !im.hasTests() {
+		return nil, nil
+	}
+	return formatGenerated(im.TestOutputFile(), im.FprintTests)
+}
+
+// FprintTests prints instantiated tests of generic packages to w
+func (im *Impl) FprintTests(w io.Writer) (err error) {
+	defer bpan.RecoverTo(&err)
+	fmt.Fprintf(w, "%s\npackage %s\n\n", preambleComment, im.pkgName)
+	if !im.imports.IsEmpty() {
+		newAstPrinter(w, nil).println(im.imports.decl())
+	}
+	printed := sets.NewStrSet()
+	for _, path := range im.pkgOrder {
+		im.pkg[path].printTests(w, printed)
+	}
+	return
+}
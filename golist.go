@@ -0,0 +1,53 @@
+package typeinst
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// listedPkg is the subset of `go list -json` output used by typeinst
+type listedPkg struct {
+	ImportPath     string
+	Name           string
+	Dir            string
+	Export         string // export data file, requires -export flag
+	GoFiles        []string
+	IgnoredGoFiles []string // files excluded by build constraints
+	Module         *struct {
+		Path string
+		Main bool // is it the main module (of the dir go list is run in)?
+	}
+	Error *struct {
+		Err string
+	}
+}
+
+// goList runs `go list -e -json [flags] pkgs...` in dir, packages are returned in the output order.
+func goList(dir string, flags []string, pkgs ...string) ([]*listedPkg, error) {
+	args := append([]string{"list", "-e", "-json=ImportPath,Name,Dir,Export,GoFiles,IgnoredGoFiles,Module,Error"}, flags...)
+	args = append(args, pkgs...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list %s: %v: %s", strings.Join(pkgs, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var res []*listedPkg
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		p := &listedPkg{}
+		if err := dec.Decode(p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("go list: bad output: %v", err)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
@@ -1,10 +1,9 @@
-package main
+package typeinst
 
 import (
 	"fmt"
 	"go/ast"
 	"go/token"
-	"log"
 	"strings"
 )
 
@@ -12,6 +11,7 @@ import (
 type Imports struct {
 	p2n map[string]string // path -> name, one side of bimap
 	n2p map[string]string // the other side
+	gen int               // number of names generated by Merge()
 }
 
 func (im *Imports) init() {
@@ -37,7 +37,7 @@ func importSpecName(spec *ast.ImportSpec) string {
 		return r == '"' || r == '/'
 	})
 	if len(a) == 0 {
-		log.Fatal("Nameless import spec")
+		bpan.Panicf("nameless import spec: %s", spec.Path.Value)
 	}
 	return a[len(a)-1]
 
@@ -73,7 +73,8 @@ func (im *Imports) Add(n, p string) error {
 func (im *Imports) Merge(other Imports) map[string]string {
 	add := [][2]string{}
 	rename := make(map[string]string)
-	for n, p := range other.n2p {
+	for _, n := range sortedKeys(other.n2p) {
+		p := other.n2p[n]
 		oldn, hasp := im.p2n[p]
 		_, hasn := im.n2p[n]
 		if hasp {
@@ -84,7 +85,7 @@ func (im *Imports) Merge(other Imports) map[string]string {
 			if !hasn {
 				add = append(add, [2]string{n, p})
 			} else {
-				gs := genSymbol("_Pkg")
+				gs := im.genName("_Pkg")
 				rename[n] = gs
 				add = append(add, [2]string{gs, p})
 			}
@@ -96,9 +97,21 @@ func (im *Imports) Merge(other Imports) map[string]string {
 	return rename
 }
 
+// genName returns unused import name with the prefix, names are numbered per Imports so the output is reproducible
+func (im *Imports) genName(prefix string) string {
+	for {
+		im.gen++
+		n := fmt.Sprintf("%s_%d", prefix, im.gen)
+		if _, has := im.n2p[n]; !has {
+			return n
+		}
+	}
+}
+
 func (im *Imports) decl() *ast.GenDecl {
 	specs := make([]ast.Spec, 0, len(im.n2p))
-	for n, p := range im.n2p {
+	for _, p := range sortedKeys(im.p2n) {
+		n := im.p2n[p]
 		spec := &ast.ImportSpec{
 			Name: &ast.Ident{
 				Name: n,
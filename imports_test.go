@@ -1,6 +1,7 @@
-package main
+package typeinst
 
 import (
+	"go/ast"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,8 +32,19 @@ func TestImportsMerge(t *testing.T) {
 	rename1 := im1.Merge(im2)
 
 	assert.Len(t, rename1, 1)
-	_, has := rename1["n1"]
-	assert.True(t, has)
-	_, has = im1.p2n["p3"]
+	assert.Equal(t, "_Pkg_1", rename1["n1"])
+	_, has := im1.p2n["p3"]
 	assert.True(t, has)
 }
+
+func TestImportsDeclSorted(t *testing.T) {
+	im := Imports{}
+	im.Add("z", `"a/z"`)
+	im.Add("b", `"b"`)
+	im.Add("a", `"c/a"`)
+	paths := []string{}
+	for _, spec := range im.decl().Specs {
+		paths = append(paths, spec.(*ast.ImportSpec).Path.Value)
+	}
+	assert.Equal(t, []string{`"a/z"`, `"b"`, `"c/a"`}, paths)
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// !!! Modified version (1.9.2) of "go/printer" package: RenameFunc added
+// !!! Modified version (1.9.2) of "go/printer" package: RenameFunc and Unqualify added
 // Package printer implements printing of AST nodes.
 package printer
 
@@ -740,8 +740,11 @@ func (p *printer) intersperseComments(next token.Position, tok token.Token) (wro
 	var last *ast.Comment
 	for p.commentBefore(next) {
 		for _, c := range p.comment.List {
-			// Skipping_comments:  p.writeCommentPrefix(p.posFor(c.Pos()), next, last, tok)
-			// Skipping_comments:  p.writeComment(c)
+			// comments are skipped unless KeepComments is set, since generic code is printed under other names
+			if p.Config.Mode&KeepComments != 0 {
+				p.writeCommentPrefix(p.posFor(c.Pos()), next, last, tok)
+				p.writeComment(c)
+			}
 			last = c
 		}
 		p.nextComment()
@@ -1277,16 +1280,21 @@ const (
 	TabIndent                  // use tabs for indentation independent of UseSpaces
 	UseSpaces                  // use spaces instead of tabs for alignment
 	SourcePos                  // emit //line directives to preserve original source positions
+	KeepComments               // print comments (they are skipped by default)
 )
 
 type RenameFunc = func(*ast.Ident) string
 
+// UnqualifyFunc reports whether the qualifier of package member selector is dropped (only its Sel is printed)
+type UnqualifyFunc = func(*ast.SelectorExpr) bool
+
 // A Config node controls the output of Fprint.
 type Config struct {
 	Mode       Mode // default: 0
 	Tabwidth   int  // default: 8
 	Indent     int  // default: 0 (all code is indented at least by this much)
 	RenameFunc RenameFunc
+	Unqualify  UnqualifyFunc
 }
 
 // fprint implements Fprint and takes a nodesSizes map for setting up the printer state.
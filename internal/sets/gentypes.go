@@ -1,4 +1,5 @@
-package main
+// Package sets contains the sets used by typeinst internally, they are generated by typeinst itself.
+package sets
 
 import (
 	"go/ast"
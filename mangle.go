@@ -1,4 +1,4 @@
-package main
+package typeinst
 
 import (
 	"strings"
@@ -37,6 +37,14 @@ func MangleDepTypeName(orig, gen, inst string) string {
 	return strEnsureCase(n, isUpper)
 }
 
+// MangleNonGenericName mangles the name of non-generic declaration copied from generic package.
+// orig - original name, pkg - generic package name
+func MangleNonGenericName(orig, pkg string) string {
+	n, isUpper := strUpcase(orig)
+	pkg, _ = strUpcase(pkg)
+	return strEnsureCase(pkg+n, isUpper)
+}
+
 func strUpcase(s string) (string, bool) {
 	return strReplaceFirst(s, unicode.IsUpper, unicode.ToUpper)
 }
@@ -1,4 +1,4 @@
-package main
+package typeinst
 
 import "testing"
 import "github.com/stretchr/testify/assert"
@@ -29,3 +29,8 @@ func TestMangleDepType(t *testing.T) {
 		assert.Equal(t, tc[3], MangleDepTypeName(tc[0], tc[1], tc[2]))
 	}
 }
+
+func TestMangleNonGeneric(t *testing.T) {
+	assert.Equal(t, "setDescribe", MangleNonGenericName("describe", "set"))
+	assert.Equal(t, "SetHelper", MangleNonGenericName("Helper", "set"))
+}
@@ -0,0 +1,225 @@
+package typeinst
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dlepex/typeinst/internal/sets"
+)
+
+type (
+	// Manifest describes instances as data, it is an alternative to dsl-struct (e.g. typeinst.json), see ParseManifest.
+	Manifest struct {
+		Package string            `json:"package"` // generated package name, if empty the package of manifest dir is used
+		Output  string            `json:"output"`  // generated file relative to manifest dir, default is <manifest name><suffix>.go
+		Imports map[string]string `json:"imports"` // packages referred by type arguments: name -> path
+		Types   []ManifestItem    `json:"types"`
+	}
+	// ManifestItem corresponds to the field of dsl-struct
+	ManifestItem struct {
+		Name    string            `json:"name"`    // instance name
+		Generic string            `json:"generic"` // generic type e.g. "github.com/dlepex/genericlib/set.Set", or "Type" for local generic type
+		Merge   []string          `json:"merge"`   // other generic types merged into instance (like several results of dsl-func)
+		Args    map[string]string `json:"args"`    // typevar -> type argument
+		pos     token.Position
+	}
+)
+
+// isManifest reports whether file is a manifest rather than .go file with dsl-struct
+func isManifest(file string) bool {
+	return strings.HasSuffix(file, ".json")
+}
+
+// ParseManifest parses JSON manifest into DSL, which is validated the same way as dsl-struct, see ManifestDSL.
+func ParseManifest(filename string) (*DSL, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: bad manifest: %v", filename, err)
+	}
+	offsets := manifestItemOffsets(data)
+	for i := range m.Types {
+		m.Types[i].pos = token.Position{Filename: filename}
+		if i < len(offsets) {
+			m.Types[i].pos = offsetPosition(filename, data, offsets[i])
+		}
+	}
+	return ManifestDSL(&m, filename)
+}
+
+// manifestItemOffsets returns offsets of "types" elements of JSON manifest
+func manifestItemOffsets(data []byte) (offsets []int) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return
+		}
+		if key != "types" {
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return
+		}
+		for dec.More() {
+			off := int(dec.InputOffset())
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return
+			}
+			offsets = append(offsets, off)
+		}
+		return
+	}
+	return
+}
+
+func offsetPosition(filename string, data []byte, off int) token.Position {
+	for off < len(data) && strings.ContainsRune(" \t\r\n,", rune(data[off])) {
+		off++
+	}
+	line := 1 + bytes.Count(data[:off], []byte("\n"))
+	return token.Position{Filename: filename, Offset: off, Line: line, Column: off - bytes.LastIndexByte(data[:off], '\n')}
+}
+
+// ManifestDSL converts m into DSL (filename is used for positions, output file and local generic types),
+// in case of bad items the valid part of dsl is returned together with ErrorList describing all bad items.
+func ManifestDSL(m *Manifest, filename string) (dsl *DSL, err error) {
+	defer bpan.RecoverTo(&err)
+	dsl = &DSL{
+		PkgName:  m.Package,
+		Filename: filename,
+		Output:   m.Output,
+	}
+	var errs ErrorList
+	if dsl.Output != "" && !strings.HasSuffix(dsl.Output, ".go") {
+		errs.Addf("%s: manifest output must be .go file: %s", filename, dsl.Output)
+	}
+	if dsl.PkgName == "" {
+		if dsl.PkgName, err = dirPackageName(filepath.Dir(filename)); err != nil {
+			errs.Add(err)
+		}
+	}
+	imports := Imports{}
+	for _, n := range sortedKeys(m.Imports) {
+		errs.Add(imports.Add(n, strconv.Quote(m.Imports[n])))
+	}
+	names := sets.NewStrSet()
+	stringer := astStringer{}
+	for i := range m.Types {
+		mi := &m.Types[i]
+		it := &DSLItem{
+			InstName: mi.Name,
+			TypeArgs: make(map[string]string),
+			Pos:      mi.pos,
+		}
+		if !it.Pos.IsValid() {
+			it.Pos.Filename = filename
+		}
+		ok := errs.CatchAt(it.Pos, func() {
+			estr := func(s string) string {
+				return s + " [in manifest item: " + it.InstName + "]"
+			}
+			if !token.IsIdentifier(mi.Name) {
+				bpan.Panicf("manifest item name must be Go identifier, found: %q", mi.Name)
+			}
+			if names.Contains(mi.Name) {
+				bpan.Panicf(estr("repeated instance name"))
+			}
+			names.Add(mi.Name)
+			if len(mi.Args) == 0 {
+				bpan.Panicf(estr("manifest item has no args i.e. typevar substitutions"))
+			}
+			pkgs := sets.NewStrSet()
+			for _, tv := range sortedKeys(mi.Args) {
+				if !token.IsIdentifier(tv) {
+					bpan.Panicf(estr("typevar must be Go identifier, found: %q"), tv)
+				}
+				x, err := parser.ParseExpr(mi.Args[tv])
+				if err != nil {
+					bpan.Panicf(estr("bad type argument of %s: %q"), tv, mi.Args[tv])
+				}
+				ast.Walk(pkgNameWalker(pkgs), x)
+				it.TypeArgs[tv] = stringer.ToString(x)
+			}
+			for _, pkgname := range sortedStrs(pkgs) {
+				p := imports.Named(pkgname)
+				if p == "" {
+					bpan.Panicf(estr("package %s of type argument is not in manifest imports"), pkgname)
+				}
+				bpan.Check(dsl.Imports.Add(pkgname, p))
+			}
+			qtset := sets.NewStrSet()
+			for _, g := range append([]string{mi.Generic}, mi.Merge...) {
+				pair, err := parseManifestGeneric(g)
+				if err != nil {
+					bpan.Panicf(estr("%v"), err)
+				}
+				if qtset.Contains(g) {
+					bpan.Panicf(estr("merging repeated generic type: %v"), g)
+				}
+				qtset.Add(g)
+				it.GenericTypes = append(it.GenericTypes, pair)
+			}
+		})
+		if ok {
+			dsl.Items = append(dsl.Items, it)
+		}
+	}
+	if len(m.Types) == 0 {
+		errs.Addf("%s: manifest has no types", filename)
+	}
+	return dsl, errs.Err()
+}
+
+// parseManifestGeneric parses "import/path.Type" (or just "Type" for local generic type)
+func parseManifestGeneric(g string) (PkgTypePair, error) {
+	p, typ := localPkgPath, g
+	if i := strings.LastIndex(g, "."); i > strings.LastIndex(g, "/") {
+		p, typ = strconv.Quote(g[:i]), g[i+1:]
+	}
+	if !token.IsIdentifier(typ) || p == `""` || strings.HasSuffix(g, "/") {
+		return PkgTypePair{}, fmt.Errorf("generic type must be \"import/path.Type\" or \"Type\" (local generic type), found: %q", g)
+	}
+	return PkgTypePair{PkgName: p, Type: typ}, nil
+}
+
+// dirPackageName returns the name of package in dir, or the name of dir if it has no .go files
+func dirPackageName(dir string) (string, error) {
+	m, err := parser.ParseDir(token.NewFileSet(), dir, pkgFileFilter, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	for name := range m {
+		if len(m) > 1 {
+			return "", fmt.Errorf("manifest package must be set, several packages found in %s", dir)
+		}
+		return name, nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(filepath.ToSlash(abs)), nil
+}
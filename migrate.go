@@ -0,0 +1,678 @@
+package typeinst
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pri "github.com/dlepex/typeinst/internal/printer"
+	"github.com/dlepex/typeinst/internal/sets"
+)
+
+// Migrate converts generic packages used by dsl-structs of opts.File into packages with type parameters (Go 1.18),
+// the dsl-structs are replaced by type aliases of instantiated types (e.g. type StrSet = set.Set[string]),
+// and the files generated by typeinst are removed. In check mode nothing is written, the diff is written to opts.Diff instead.
+func Migrate(opts Options) (err error) {
+	defer bpan.RecoverTo(&err)
+	diff := opts.Diff
+	if diff == nil {
+		diff = ioutil.Discard
+	}
+	if opts.StructName == "" {
+		opts.StructName = DefaultStructName
+	}
+	if opts.Suffix == "" {
+		opts.Suffix = FileSuffix
+	}
+	dsls, err := ParseDSLs(opts.File, opts.StructName)
+	if err != nil {
+		return err
+	}
+	// all dsl-structs of the file are migrated together: generic packages are rewritten once
+	all := &DSL{PkgName: dsls[0].PkgName, Filename: opts.File}
+	for _, d := range dsls {
+		all.Imports.Merge(d.Imports)
+		all.Items = append(all.Items, d.Items...)
+		for _, w := range d.Warnings {
+			logf(opts.Logger, "%s", w)
+		}
+	}
+	impl := NewImpl(opts.File, all.PkgName)
+	impl.session = NewSession()
+	impl.log = opts.Logger
+	if err := dsl2Impl(all, impl); err != nil {
+		return err
+	}
+	var errs ErrorList
+	files := make(map[string][]byte)
+	migs := make(map[string]*pkgMigration)
+	for _, path := range impl.pkgOrder {
+		if path == localPkgPath {
+			errs.Addf("local generic types (templates) cannot be migrated")
+			continue
+		}
+		m, err := newPkgMigration(impl, path)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		errs.Add(m.rewrite(files))
+		migs[path] = m
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	src, err := migrateDSLFile(opts, all, impl.pkgOrder, migs)
+	if err != nil {
+		return err
+	}
+	files[opts.File] = src
+	var remove []string
+	for _, d := range dsls {
+		out, err := d.OutputFile(opts.StructName, opts.Suffix)
+		bpan.Check(err)
+		for _, f := range []string{out, strings.TrimSuffix(out, ".go") + "_test.go"} {
+			if pathExists(f) {
+				remove = append(remove, f)
+			}
+		}
+	}
+	names := make([]string, 0, len(files))
+	for f := range files {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	for _, f := range names {
+		if opts.Check {
+			_, err = checkFile(diff, f, files[f])
+		} else {
+			err = writeIfChanged(f, files[f], opts.Logger)
+		}
+		bpan.Check(err)
+	}
+	for _, f := range remove {
+		if opts.Check {
+			_, err := fmt.Fprintf(diff, "remove %s\n", f)
+			bpan.Check(err)
+			continue
+		}
+		logf(opts.Logger, "removing: %s", f)
+		bpan.Check(os.Remove(f))
+	}
+	return nil
+}
+
+// pkgMigration describes the conversion of generic package to type parameters:
+// each typevar becomes the type parameter (of the same name) of all generic types and funcs depending on it.
+type pkgMigration struct {
+	pd          *PkgDesc
+	path        string // quoted package path
+	dir         string
+	files       map[string]*ast.File // non-test files of the package
+	order       []string             // typevars in declaration order, it is the order of type parameters
+	tparams     map[string][]string  // generic type or func name -> its typevars
+	constraints map[string]string    // typevar -> constraint
+	occ         map[*ast.Ident]string
+}
+
+func newPkgMigration(impl *Impl, path string) (m *pkgMigration, err error) {
+	defer bpan.RecoverTo(&err)
+	pd := impl.pkg[path]
+	dir, err := impl.session.packageDir(filepath.Dir(impl.outputFile), unquote(path))
+	bpan.Check(err)
+	bpan.Check(checkMainModule(filepath.Dir(impl.outputFile), unquote(path)))
+	fset, pkgs, err := impl.session.parseDir(dir)
+	bpan.Check(err)
+	m = &pkgMigration{
+		pd:          pd,
+		path:        path,
+		dir:         dir,
+		files:       make(map[string]*ast.File),
+		tparams:     make(map[string][]string),
+		constraints: make(map[string]string),
+		occ:         make(map[*ast.Ident]string),
+	}
+	tests := make(map[string]*ast.File)
+	for _, pkg := range pkgs {
+		for fn, f := range pkg.Files {
+			if strings.HasSuffix(fn, "_test.go") {
+				tests[fn] = f
+			} else {
+				m.files[fn] = f
+			}
+		}
+	}
+	// only the types reachable from dsl-struct are resolved by typeinst, but all of them are migrated
+	for _, t := range pd.sortedTypes() {
+		if !t.isTypevar && !t.isVisited {
+			pd.resolveRecur(t, nil, sets.NewStrSet())
+		}
+	}
+	m.order = pd.typevarOrder()
+	var errs ErrorList
+	for _, t := range pd.sortedTypes() {
+		if t.isTypevar || !t.isGeneric() {
+			continue
+		}
+		if t.spec.TypeParams != nil {
+			errs.Add(errorfAt(pd.position(t.spec), "generic type %s has type parameters, it cannot be migrated", t.name()))
+			continue
+		}
+		m.tparams[t.name()] = m.typevarList(t.typevars)
+	}
+	m.resolveFuncs()
+	errs.Add(m.checkTests(fset, tests))
+	errs.Add(m.checkMethods())
+	errs.Add(m.resolveConstraints())
+	bpan.Check(errs.Err())
+	return m, nil
+}
+
+func (m *pkgMigration) typevarList(tvs sets.StrSet) []string {
+	var res []string
+	for _, tv := range m.order {
+		if tvs.Contains(tv) {
+			res = append(res, tv)
+		}
+	}
+	return res
+}
+
+// dependsOn returns typevars which node depends on (directly or via generic types and funcs)
+func (m *pkgMigration) dependsOn(nodes ...ast.Node) sets.StrSet {
+	tvs := sets.NewStrSet()
+	var w astWalker = func(p astWalkerParams) {
+		n := p.id.Name
+		if p.kind == ast.Pkg {
+			return
+		}
+		if m.pd.typevars.Contains(n) && (p.kind == ast.Typ || p.kind == ast.Bad) {
+			tvs.Add(n)
+			return
+		}
+		tvs.AddMany(m.tparams[n]...)
+	}
+	for _, n := range nodes {
+		if n != nil && !isNilNode(n) {
+			ast.Walk(w, n)
+		}
+	}
+	return tvs
+}
+
+func isNilNode(n ast.Node) bool {
+	switch n := n.(type) {
+	case *ast.BlockStmt:
+		return n == nil
+	case *ast.FieldList:
+		return n == nil
+	}
+	return false
+}
+
+// resolveFuncs finds typevars of free standing funcs (including ctors), funcs may depend on each other
+func (m *pkgMigration) resolveFuncs() {
+	funcs := make(map[string]*ast.FuncDecl)
+	for n, f := range m.pd.funcs {
+		funcs[n] = f
+	}
+	for n, t := range m.pd.ctors {
+		for _, f := range t.ctors {
+			if f.Name.Name == n {
+				funcs[n] = f
+			}
+		}
+	}
+	names := make([]string, 0, len(funcs))
+	for n := range funcs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for changed := true; changed; {
+		changed = false
+		for _, n := range names {
+			f := funcs[n]
+			l := m.typevarList(m.dependsOn(f.Type, f.Body))
+			if len(l) != len(m.tparams[n]) {
+				m.tparams[n] = l
+				changed = true
+			}
+		}
+	}
+}
+
+// checkTests reports test files (of the package or its _test package) which refer to typevars or generic declarations:
+// tests cannot have type parameters, so they are not migrated, and they would not compile after migration.
+func (m *pkgMigration) checkTests(fset *token.FileSet, tests map[string]*ast.File) error {
+	var errs ErrorList
+	for _, fn := range sortedFiles(tests) {
+		var ref *ast.Ident // the first one, a file is reported once
+		ast.Inspect(tests[fn], func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && ref == nil && (m.pd.typevars.Contains(id.Name) || len(m.tparams[id.Name]) != 0) {
+				ref = id
+			}
+			return ref == nil
+		})
+		if ref != nil {
+			errs.Add(errorfAt(fset.Position(ref.Pos()), "test file refers to generic %s, tests of generic packages cannot be migrated, migrate (or remove) them manually", ref.Name))
+		}
+	}
+	return errs.Err()
+}
+
+// checkMethods reports methods which depend on typevars of other generic types, since methods cannot have type parameters
+func (m *pkgMigration) checkMethods() error {
+	var errs ErrorList
+	for _, t := range m.pd.sortedTypes() {
+		if t.isTypevar {
+			continue
+		}
+		for _, f := range t.methods {
+			tvs := m.dependsOn(f.Type, f.Body)
+			tvs.Subtract(t.typevars)
+			if len(tvs) != 0 {
+				errs.Add(errorfAt(m.pd.position(f), "method %s.%s depends on typevars %s, which are not typevars of %s",
+					t.name(), f.Name.Name, strings.Join(m.typevarList(tvs), ", "), t.name()))
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// resolveConstraints derives type parameter constraint of each typevar: non-empty interface typevar is used as is,
+// typevar which is used as map key or compared is "comparable", the others are "any".
+func (m *pkgMigration) resolveConstraints() error {
+	var errs ErrorList
+	comparable := m.comparableTypevars()
+	for _, tv := range m.order {
+		t := m.pd.types[tv]
+		switch x := t.spec.Type.(type) {
+		case *ast.InterfaceType:
+		case *ast.Ident:
+			if x.Name != "any" {
+				errs.Add(errorfAt(m.pd.position(t.spec), "typevar %s is not an interface, its constraint cannot be derived", tv))
+				continue
+			}
+		default:
+			errs.Add(errorfAt(m.pd.position(t.spec), "typevar %s is not an interface, its constraint cannot be derived", tv))
+			continue
+		}
+		switch {
+		case t.constraint() != nil:
+			m.markRefs(t.spec.Type)
+			buf := &bytes.Buffer{}
+			m.printer().Fprint(buf, m.pd.fset, t.spec.Type)
+			m.constraints[tv] = buf.String()
+		case comparable.Contains(tv):
+			m.constraints[tv] = "comparable"
+		default:
+			m.constraints[tv] = "any"
+		}
+	}
+	return errs.Err()
+}
+
+// comparableTypevars type-checks the package to find typevars used as map keys or operands of ==, != and switch.
+// Typevars are temporarily declared as defined types (not aliases), so that they are distinguishable from interface{}.
+func (m *pkgMigration) comparableTypevars() sets.StrSet {
+	res := sets.NewStrSet()
+	for tv := range m.pd.typevars {
+		spec := m.pd.types[tv].spec
+		if assign := spec.Assign; assign.IsValid() {
+			spec.Assign = token.NoPos
+			defer func() { spec.Assign = assign }()
+		}
+	}
+	var files []*ast.File
+	for _, fn := range sortedFiles(m.files) {
+		files = append(files, m.files[fn])
+	}
+	imp, err := newExportImporter(m.pd.fset, m.dir, files)
+	if err != nil {
+		logf(m.pd.log, "migrate: cannot type-check %s, typevars are not comparable: %v", m.path, err)
+		return res
+	}
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	conf := types.Config{Importer: imp, Error: func(error) {}}
+	pkg, _ := conf.Check(unquote(m.path), m.pd.fset, files, info)
+	add := func(e ast.Expr) {
+		if e == nil {
+			return
+		}
+		if n, ok := info.Types[e].Type.(*types.Named); ok && n.Obj().Pkg() == pkg && m.pd.typevars.Contains(n.Obj().Name()) {
+			res.Add(n.Obj().Name())
+		}
+	}
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.MapType:
+				add(x.Key)
+			case *ast.BinaryExpr:
+				if x.Op == token.EQL || x.Op == token.NEQ {
+					add(x.X)
+					add(x.Y)
+				}
+			case *ast.SwitchStmt:
+				add(x.Tag)
+			}
+			return true
+		})
+	}
+	return res
+}
+
+// markRefs marks references to generic types and funcs in node, they are printed with type arguments e.g. Set[E]
+func (m *pkgMigration) markRefs(nodes ...ast.Node) {
+	var w astWalker = func(p astWalkerParams) {
+		if p.kind == ast.Pkg {
+			return
+		}
+		if l := m.tparams[p.id.Name]; len(l) != 0 {
+			if _, has := m.occ[p.id]; !has {
+				m.occ[p.id] = p.id.Name + "[" + strings.Join(l, ", ") + "]"
+			}
+		}
+	}
+	for _, n := range nodes {
+		if n != nil && !isNilNode(n) {
+			ast.Walk(w, n)
+		}
+	}
+}
+
+// markDecl marks the name of generic declaration, it is printed with type parameters e.g. Set[E comparable]
+func (m *pkgMigration) markDecl(id *ast.Ident) {
+	l := m.tparams[id.Name]
+	if len(l) == 0 {
+		return
+	}
+	params := make([]string, len(l))
+	for i, tv := range l {
+		params[i] = tv + " " + m.constraints[tv]
+	}
+	m.occ[id] = id.Name + "[" + strings.Join(params, ", ") + "]"
+}
+
+func (m *pkgMigration) printer() *pri.Config {
+	return &pri.Config{
+		Mode:     pri.UseSpaces | pri.TabIndent | pri.KeepComments,
+		Tabwidth: 8,
+		RenameFunc: func(id *ast.Ident) string {
+			if n, ok := m.occ[id]; ok {
+				return n
+			}
+			return id.Name
+		},
+	}
+}
+
+// rewrite prints the migrated files of the package (only changed ones) to files
+func (m *pkgMigration) rewrite(files map[string][]byte) error {
+	var errs ErrorList
+	for _, fn := range sortedFiles(m.files) {
+		f := m.files[fn]
+		fc := *f
+		fc.Decls = nil
+		var removed [][2]token.Pos
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					m.markDecl(d.Name)
+				}
+				m.markRefs(d.Recv, d.Type, d.Body)
+			case *ast.GenDecl:
+				dc := *d
+				dc.Specs = nil
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if m.pd.typevars.Contains(s.Name.Name) {
+							removed = append(removed, [2]token.Pos{nodeStart(s.Doc, s), nodeEnd(s.Comment, s)})
+							continue
+						}
+						m.markDecl(s.Name)
+						m.markRefs(s.Type)
+					case *ast.ValueSpec:
+						if tvs := m.dependsOn(s); len(tvs) != 0 {
+							errs.Add(errorfAt(m.pd.position(s), "package level %s %s depends on typevars %s",
+								d.Tok, s.Names[0].Name, strings.Join(m.typevarList(tvs), ", ")))
+						}
+					}
+					dc.Specs = append(dc.Specs, spec)
+				}
+				if len(dc.Specs) == 0 {
+					removed = append(removed, [2]token.Pos{nodeStart(d.Doc, d), d.End()})
+					continue
+				}
+				decl = &dc
+			}
+			fc.Decls = append(fc.Decls, decl)
+		}
+		if len(removed) == 0 && !m.hasOcc(f) {
+			continue
+		}
+		fc.Comments = nil
+		for _, cg := range f.Comments {
+			if !within(cg, removed) {
+				fc.Comments = append(fc.Comments, cg)
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := m.printer().Fprint(buf, m.pd.fset, &fc); err != nil {
+			errs.Add(err)
+			continue
+		}
+		b, err := format.Source(buf.Bytes())
+		if err != nil {
+			errs.Add(formatError(fn, buf.Bytes(), err))
+			continue
+		}
+		files[fn] = b
+	}
+	return errs.Err()
+}
+
+func (m *pkgMigration) hasOcc(f *ast.File) bool {
+	for id := range m.occ {
+		if id.Pos() >= f.Pos() && id.End() <= f.End() {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeStart(doc *ast.CommentGroup, n ast.Node) token.Pos {
+	if doc != nil {
+		return doc.Pos()
+	}
+	return n.Pos()
+}
+
+func nodeEnd(comment *ast.CommentGroup, n ast.Node) token.Pos {
+	if comment != nil && comment.End() > n.End() {
+		return comment.End()
+	}
+	return n.End()
+}
+
+func within(n ast.Node, ranges [][2]token.Pos) bool {
+	for _, r := range ranges {
+		if n.Pos() >= r[0] && n.End() <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateDSLFile replaces dsl-structs of the file by the type aliases of instantiated types and by the vars of ctors
+// (i.e. the names declared by generated file are kept).
+func migrateDSLFile(opts Options, dsl *DSL, pkgOrder []string, migs map[string]*pkgMigration) ([]byte, error) {
+	src, err := ioutil.ReadFile(opts.File)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, opts.File, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var imports Imports
+	for _, spec := range f.Imports {
+		bpan.Check(imports.AddSpec(spec))
+	}
+	var errs ErrorList
+	aliases, vars := &bytes.Buffer{}, &bytes.Buffer{}
+	emitted := sets.NewStrSet()
+	emit := func(m *pkgMigration, t *TypeDesc, args *TypeArgs) {
+		inst := t.inst[args]
+		if emitted.Contains(inst) {
+			return
+		}
+		emitted.Add(inst)
+		if !ast.IsExported(t.name()) {
+			logf(m.pd.log, "migrate: type %s is not exported, %s is not declared", t.name(), inst)
+			return
+		}
+		qual := imports.p2n[m.path] + "."
+		targs := func(name string) string {
+			var a []string
+			for _, tv := range m.tparams[name] {
+				arg, ok := args.Binds[tv]
+				if !ok {
+					errs.Addf("typevar %s of %s is unbound for %s", tv, name, inst)
+				}
+				a = append(a, arg)
+			}
+			return "[" + strings.Join(a, ", ") + "]"
+		}
+		typ := qual + t.name() + targs(t.name())
+		switch {
+		case t.isFunc:
+			fmt.Fprintf(vars, "%s = %s\n", inst, typ)
+		case t.isSingleFunc():
+			fmt.Fprintf(vars, "%s = %s{}.Apply\n", inst, typ)
+		case t.isSingleton:
+			fmt.Fprintf(aliases, "%s = %s\n", t.printedName(inst), typ)
+			fmt.Fprintf(vars, "%s %s\n", inst, t.printedName(inst))
+		default:
+			fmt.Fprintf(aliases, "%s = %s\n", inst, typ)
+		}
+		for _, c := range t.ctors {
+			if ast.IsExported(c.Name.Name) {
+				fmt.Fprintf(vars, "%s = %s%s%s\n", MangleCtorName(c.Name.Name, t.name(), inst), qual, c.Name.Name, targs(c.Name.Name))
+			}
+		}
+	}
+	for _, it := range dsl.Items {
+		if len(it.GenericTypes) > 1 {
+			errs.Add(errorfAt(it.Pos, "merged type %s cannot be migrated", it.InstName))
+			continue
+		}
+		g := it.GenericTypes[0]
+		m := migs[g.PkgName]
+		typeArgs := it.TypeArgs
+		if len(g.Args) != 0 {
+			typeArgs, _ = m.pd.bindTypeArgs(g.Type, g.Args) // errors are reported by AddDSL
+		}
+		emit(m, m.pd.types[g.Type], m.pd.targs.of(typeArgs))
+	}
+	// dependent types, their names are derived from the names of dsl-struct fields
+	for _, path := range pkgOrder {
+		m := migs[path]
+		for _, t := range m.pd.sortedTypes() {
+			if t.isGeneric() && t.isVisited {
+				for _, args := range t.instOrder {
+					emit(m, t, args)
+				}
+			}
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	decls := &bytes.Buffer{}
+	if aliases.Len() != 0 {
+		fmt.Fprintf(decls, "type (\n%s)\n", aliases)
+	}
+	if vars.Len() != 0 {
+		fmt.Fprintf(decls, "\nvar (\n%s)\n", vars)
+	}
+	var spans [][2]token.Pos
+	for _, cg := range f.Comments {
+		// the file of dsl-struct may be excluded from the build by typeinst tag, see README
+		if cg.Pos() < f.Package && isTemplateFile(&ast.File{Package: f.Package, Comments: []*ast.CommentGroup{cg}}) {
+			spans = append(spans, [2]token.Pos{cg.Pos(), cg.End()})
+		}
+	}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		dslSpecs := 0
+		for _, spec := range gd.Specs {
+			if strings.HasPrefix(spec.(*ast.TypeSpec).Name.Name, opts.StructName) {
+				dslSpecs++
+			}
+		}
+		if dslSpecs == 0 {
+			continue
+		}
+		if dslSpecs != len(gd.Specs) {
+			return nil, errorfAt(fset.Position(gd.Pos()), "dsl-struct is declared together with other types, it cannot be migrated")
+		}
+		spans = append(spans, [2]token.Pos{nodeStart(gd.Doc, gd), gd.End()})
+	}
+	out := &bytes.Buffer{}
+	last := 0
+	for i, s := range spans {
+		start, end := fset.Position(s[0]).Offset, fset.Position(s[1]).Offset
+		out.Write(src[last:start])
+		if s[0] > f.Package && decls != nil {
+			out.Write(decls.Bytes())
+			decls = nil
+		}
+		last = end
+		if i == len(spans)-1 {
+			out.Write(src[last:])
+		}
+	}
+	b, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, formatError(opts.File, out.Bytes(), err)
+	}
+	return pruneImports(b)
+}
+
+// checkMainModule returns an error if package path does not belong to the main module of dir:
+// packages of the other modules (e.g. in module cache) must not be rewritten in place.
+func checkMainModule(dir, path string) error {
+	pkgs, err := goList(dir, nil, path)
+	if err != nil {
+		return err
+	}
+	for _, p := range pkgs {
+		if p.ImportPath != path {
+			continue
+		}
+		if p.Module == nil {
+			return fmt.Errorf("package %s is not in a module, it cannot be migrated", path)
+		}
+		if !p.Module.Main {
+			return fmt.Errorf("package %s is outside the main module (it belongs to %s), it cannot be migrated", path, p.Module.Path)
+		}
+		return nil
+	}
+	return fmt.Errorf("no such package: %s", path)
+}
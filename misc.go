@@ -1,37 +1,58 @@
-package main
+package typeinst
 
 import (
-	"bufio"
 	"bytes"
-	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
-	"sync"
-	"sync/atomic"
 
 	"github.com/dlepex/typeinst/internal/pan"
+	"github.com/dlepex/typeinst/internal/sets"
 )
 
 var bpan = pan.NewBounded()
 
-var symCounter int64 = 9
-
-func genSymbol(prefix string) string {
-	return fmt.Sprintf("%s_%d", prefix, atomic.AddInt64(&symCounter, 1))
+// logf writes the message to l, nil logger discards it
+func logf(l *log.Logger, format string, args ...interface{}) {
+	if l != nil {
+		l.Printf(format, args...)
+	}
 }
 
-func dictStr(d map[string]string) (keystr, str string) {
-	if len(d) == 0 {
-		return "", ""
-	}
+func sortedKeys(d map[string]string) []string {
 	keys := make([]string, 0, len(d))
 	for k := range d {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
+	return keys
+}
+
+func copyTypeArgs(d map[string]string) map[string]string {
+	c := make(map[string]string, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
+func sortedStrs(s sets.StrSet) []string {
+	a := make([]string, 0, len(s))
+	for k := range s {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+func dictStr(d map[string]string) (keystr, str string) {
+	if len(d) == 0 {
+		return "", ""
+	}
+	keys := sortedKeys(d)
 	b := bytes.NewBuffer(make([]byte, 0, 64))
 	bk := bytes.NewBuffer(make([]byte, 0, 64))
 	for _, k := range keys {
@@ -48,26 +69,24 @@ func dictStr(d map[string]string) (keystr, str string) {
 // TypeArgs is cached typevar bindings map, *TypeArgs is used as map key.
 type TypeArgs struct {
 	Binds map[string]string // typevar -> replacement
-	Key   string            // unique string for targsCache
+	Key   string            // unique string of Binds, the key of typeArgsCache
 	Shape string            // unique string of Binds map keys
 }
 
-var targsCache = make(map[string]*TypeArgs)
-var bindsCacheLock sync.Mutex
+// typeArgsCache makes equal bindings the same *TypeArgs, it is owned by Impl (so it is not safe for concurrent use)
+type typeArgsCache map[string]*TypeArgs
 
-// TypeArgsOf returns cached result
-func TypeArgsOf(m map[string]string) *TypeArgs {
+// of returns cached result
+func (c typeArgsCache) of(m map[string]string) *TypeArgs {
 	if len(m) == 0 {
 		return nil
 	}
-	bindsCacheLock.Lock()
-	defer bindsCacheLock.Unlock()
 	shape, key := dictStr(m)
-	if b, ok := targsCache[key]; ok {
+	if b, ok := c[key]; ok {
 		return b
 	}
 	b := &TypeArgs{m, key, shape}
-	targsCache[key] = b
+	c[key] = b
 	return b
 }
 
@@ -90,37 +109,63 @@ func unquote(s string) string {
 	return s
 }
 
-func packagePath(pkg string) string {
-	cmd := exec.Command("go", "list", "-m", "all")
-	b, err := cmd.CombinedOutput()
+// packageDirs resolves import paths to package dirs by a single `go list` run in dir,
+// so the main module, replace directives, vendored modules and workspaces are all supported.
+func packageDirs(dir string, pkgs ...string) (map[string]string, error) {
+	listed, err := goList(dir, nil, pkgs...)
 	if err != nil {
-		//no go modules:
-		return packagePathGopath(pkg, "src")
-	}
-	sc := bufio.NewScanner(bytes.NewReader(b))
-	for sc.Scan() {
-		sp := strings.Split(sc.Text(), " ")
-		mod, ver := sp[0], ""
-		if len(sp) == 2 {
-			ver = sp[1]
+		return nil, err
+	}
+	dirs := make(map[string]string)
+	reported := sets.NewStrSet()
+	var errs ErrorList
+	for _, p := range listed {
+		if p.Error != nil || p.Dir == "" {
+			msg := "go list reported no dir"
+			if p.Error != nil {
+				msg = p.Error.Err
+			}
+			errs.Addf("no such package: %s (%s)", p.ImportPath, msg)
+			reported.Add(p.ImportPath)
+			continue
 		}
-		if strings.HasPrefix(pkg, mod) {
-			suffix := pkg[len(mod):]
-			full := mod + "@" + ver + suffix
-			return packagePathGopath(full, "pkg/mod")
+		dirs[p.ImportPath] = p.Dir
+	}
+	for _, p := range pkgs {
+		if _, ok := dirs[p]; !ok && !reported.Contains(p) {
+			errs.Addf("no such package: %s (go list reported no dir)", p)
 		}
 	}
-	return ""
+	return dirs, errs.Err()
 }
 
-func packagePathGopath(pkg string, subdir string) string {
-	for _, dir := range filepath.SplitList(os.Getenv("GOPATH")) {
-		fullPath := filepath.Join(dir, subdir, pkg)
-		if pathExists(fullPath) {
-			return fullPath
+// writeFileAtomic writes data to temp file in the same dir and then renames it to filename,
+// so that filename is never left truncated.
+func writeFileAtomic(filename string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
 		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	if err = os.Chmod(f.Name(), perm); err != nil {
+		return err
 	}
-	return ""
+	return os.Rename(f.Name(), filename)
 }
 
 func pathExists(fpath string) bool {
@@ -0,0 +1,348 @@
+package typeinst
+
+import (
+	"bytes"
+	"go/ast"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/dlepex/typeinst/internal/sets"
+)
+
+// nonGenericCode is package level non-generic code (funcs, vars, types) used by the generated code of generic package.
+// Such code is not generated by default (it is reported as an error), in copy mode it is copied under mangled names.
+type nonGenericCode struct {
+	used    map[string]token.Pos  // name of declaration -> position of its first use
+	decls   map[string]ast.Node   // name -> *ast.FuncDecl, *ast.TypeSpec or *ast.ValueSpec
+	mangled map[string]string     // name -> mangled name (copy mode)
+	occ     map[*ast.Ident]string // occurences of copied declarations -> mangled name (copy mode)
+	generic map[string]bool       // memo of dependsOnTypevars()
+	shared  sets.StrSet           // declarations copied by the other output of the same target package, see shareNonGeneric()
+}
+
+// resolveNonGeneric finds non-generic declarations used by generated code (i.e. by instantiated types, their methods and ctors),
+// in copy mode they are copied together with the non-generic code they use, otherwise they are reported.
+func (pd *PkgDesc) resolveNonGeneric() error {
+	ng := &nonGenericCode{
+		used:    make(map[string]token.Pos),
+		decls:   make(map[string]ast.Node),
+		mangled: make(map[string]string),
+		occ:     make(map[*ast.Ident]string),
+		generic: make(map[string]bool),
+	}
+	pd.nonGen = ng
+	var use func(node ast.Node)
+	use = func(node ast.Node) {
+		pd.pkgRefs(node, func(id *ast.Ident, name string, decl ast.Node) {
+			if pd.isGenerated(name) || pd.dependsOnTypevars(name, decl) {
+				// generic code which is not generated is reported by verification
+				return
+			}
+			if _, has := ng.decls[name]; has {
+				ng.occ[id] = ng.mangled[name]
+				return
+			}
+			ng.used[name] = id.Pos()
+			ng.decls[name] = decl
+			ng.mangled[name] = MangleNonGenericName(name, pd.pkgName)
+			ng.occ[id] = ng.mangled[name]
+			if !pd.copyNonGen {
+				return
+			}
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				ng.occ[decl.Name] = ng.mangled[name]
+				use(decl.Type)
+				use(decl.Body)
+			case *ast.TypeSpec:
+				ng.occ[decl.Name] = ng.mangled[name]
+				use(decl.Type)
+				for _, f := range pd.types[name].methods {
+					use(f.Recv)
+					use(f.Type)
+					use(f.Body)
+				}
+			case *ast.ValueSpec:
+				for _, id := range decl.Names {
+					if id.Name != name {
+						// the other vars of the spec are copied too
+						ng.decls[id.Name] = decl
+						ng.mangled[id.Name] = MangleNonGenericName(id.Name, pd.pkgName)
+						ng.used[id.Name] = ng.used[name]
+					}
+					ng.occ[id] = ng.mangled[id.Name]
+				}
+				use(decl)
+			}
+			// consts and imports of copied code are substituted the same way as in generic code
+			ast.Walk(astWalker(pd.markOccurences), decl)
+		})
+	}
+	for _, t := range pd.sortedTypes() {
+		if !t.isGeneric() || !t.isVisited {
+			continue
+		}
+		if !t.isFunc {
+			use(t.spec.Type)
+		}
+		for _, f := range t.methods {
+			use(f.Type)
+			use(f.Body)
+		}
+		for _, f := range t.ctors {
+			use(f.Type)
+			use(f.Body)
+		}
+	}
+	if pd.copyNonGen {
+		return nil
+	}
+	var errs ErrorList
+	for _, name := range ng.sortedNames() {
+		decl := ng.decls[name]
+		errs.Add(errorfAt(pd.position(decl), "%s %s is not generic, so it is not generated, but it is used by generic code at %s "+
+			"(move it out of generic package, or copy it into generated file by -copy flag)", declKind(decl), name, pd.fset.Position(ng.used[name])))
+	}
+	return errs.Err()
+}
+
+func declKind(decl ast.Node) string {
+	switch decl.(type) {
+	case *ast.FuncDecl:
+		return "func"
+	case *ast.TypeSpec:
+		return "type"
+	}
+	return "var"
+}
+
+// sortedNames returns names of used declarations in source order
+func (ng *nonGenericCode) sortedNames() []string {
+	names := make([]string, 0, len(ng.decls))
+	for n := range ng.decls {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := ng.decls[names[i]].Pos(), ng.decls[names[j]].Pos()
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// isGenerated reports whether the declaration is generated: it is instantiated generic type, func or ctor
+func (pd *PkgDesc) isGenerated(name string) bool {
+	if t, ok := pd.ctors[name]; ok {
+		return t.isGeneric() && t.isVisited
+	}
+	t, ok := pd.types[name]
+	return ok && (t.isTypevar || t.isGeneric() && t.isVisited)
+}
+
+// dependsOnTypevars reports whether package level declaration depends on typevars (directly or via other declarations)
+func (pd *PkgDesc) dependsOnTypevars(name string, decl ast.Node) bool {
+	memo := pd.nonGen.generic
+	if res, ok := memo[name]; ok {
+		return res
+	}
+	memo[name] = false // recursion guard
+	res := false
+	pd.pkgRefs(declBody(pd, name, decl), func(id *ast.Ident, n string, d ast.Node) {
+		if !res {
+			t, ok := pd.types[n]
+			res = ok && (t.isTypevar || t.isGeneric()) || pd.dependsOnTypevars(n, d)
+		}
+	})
+	memo[name] = res
+	return res
+}
+
+// declBody returns the part of declaration which determines whether it is generic: func signature and body,
+// type and its method signatures (like in PkgDesc.walkType), var spec
+func declBody(pd *PkgDesc, name string, decl ast.Node) ast.Node {
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		return &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: &ast.FuncLit{Type: decl.Type, Body: decl.Body}}}}
+	case *ast.TypeSpec:
+		fields := []*ast.Field{{Type: decl.Type}}
+		for _, f := range pd.types[name].methods {
+			fields = append(fields, &ast.Field{Type: f.Type})
+		}
+		return &ast.FieldList{List: fields}
+	}
+	return decl
+}
+
+// pkgRefs calls f for each identifier of node which refers to package level func, var or type (including typevars, excluding consts)
+func (pd *PkgDesc) pkgRefs(node ast.Node, f func(id *ast.Ident, name string, decl ast.Node)) {
+	if node == nil || isNilNode(node) {
+		return
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			pd.pkgRefs(n.X, f) // selected field, method or package member is never a package level declaration
+			return false
+		case *ast.Field:
+			pd.pkgRefs(n.Type, f) // field names are not references
+			return false
+		case *ast.KeyValueExpr:
+			if _, ok := n.Key.(*ast.Ident); ok {
+				// struct field name of composite literal
+				pd.pkgRefs(n.Value, f)
+				return false
+			}
+		case *ast.Ident:
+			if decl := pd.pkgDecl(n); decl != nil {
+				f(n, n.Name, decl)
+			}
+		}
+		return true
+	})
+}
+
+// pkgDecl returns package level declaration which id refers to, or nil.
+// Identifiers declared in other files of the package are unresolved by parser, so they are looked up by name.
+func (pd *PkgDesc) pkgDecl(id *ast.Ident) ast.Node {
+	var decl ast.Node
+	if t, ok := pd.types[id.Name]; ok && t.spec != nil {
+		decl = t.spec
+		if t.isFunc {
+			decl = t.methods[0]
+		}
+	} else if t, ok := pd.ctors[id.Name]; ok {
+		for _, c := range t.ctors {
+			if c.Name.Name == id.Name {
+				decl = c
+			}
+		}
+	} else if fd, ok := pd.funcs[id.Name]; ok {
+		decl = fd
+	} else if vs, ok := pd.vars[id.Name]; ok {
+		decl = vs
+	}
+	if decl == nil || id.Obj != nil && id.Obj.Decl != decl {
+		return nil
+	}
+	return decl
+}
+
+// shareNonGeneric makes the outputs of the same target package share copied non-generic code, which would be redeclared otherwise:
+// each declaration is copied by the first of impls which uses it, the others refer to its copy under the same mangled name.
+// Declarations copied by the files generated for the target package by the other runs (e.g. by go:generate of other files)
+// are not copied again too.
+func shareNonGeneric(impls []*Impl) {
+	copied := make(map[string]sets.StrSet)   // target dir -> copied declarations (generic package path + name)
+	outputs := make(map[string]sets.StrSet)  // target dir -> absolute names of the outputs of impls
+	declared := make(map[string]sets.StrSet) // target dir -> declarations of the files generated by the other runs
+	for _, impl := range impls {
+		dir := filepath.Dir(impl.outputFile)
+		if outputs[dir] == nil {
+			outputs[dir] = sets.NewStrSet()
+		}
+		for _, f := range []string{impl.outputFile, impl.TestOutputFile()} {
+			abs, _ := filepath.Abs(f)
+			outputs[dir].Add(abs)
+		}
+	}
+	for _, impl := range impls {
+		dir := filepath.Dir(impl.outputFile)
+		if copied[dir] == nil {
+			copied[dir] = sets.NewStrSet()
+		}
+		for _, path := range impl.pkgOrder {
+			pd := impl.pkg[path]
+			if pd.nonGen == nil || !pd.copyNonGen {
+				continue
+			}
+			if declared[dir] == nil {
+				declared[dir] = generatedDecls(dir, impl.pkgName, outputs[dir])
+			}
+			pd.nonGen.shared = sets.NewStrSet()
+			for name := range pd.nonGen.decls {
+				key := path + "." + name
+				if copied[dir].Contains(key) || declared[dir].Contains(pd.nonGen.mangled[name]) {
+					pd.nonGen.shared.Add(name)
+				} else {
+					copied[dir].Add(key)
+				}
+			}
+		}
+	}
+}
+
+// generatedDecls returns the names of package level declarations of the files generated by typeinst for package pkgName in dir,
+// exclude contains absolute names of the files to skip
+func generatedDecls(dir, pkgName string, exclude sets.StrSet) sets.StrSet {
+	names := sets.NewStrSet()
+	fset := token.NewFileSet()
+	files, _ := parseTargetPkg(fset, dir, exclude, pkgName, false) // the errors are reported by verification
+	for _, f := range files {
+		b, err := ioutil.ReadFile(fset.File(f.Pos()).Name())
+		if err != nil || !bytes.HasPrefix(b, []byte(preambleComment)) {
+			continue
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					names.Add(decl.Name.Name)
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						names.Add(spec.Name.Name)
+					case *ast.ValueSpec:
+						for _, id := range spec.Names {
+							names.Add(id.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// printNonGeneric prints copied non-generic code
+func (pk *PkgDesc) printNonGeneric(wr io.Writer, typedefs sets.StrSet, origins *[]printOrigin) {
+	ng := pk.nonGen
+	if ng == nil || !pk.copyNonGen {
+		return
+	}
+	rename := pk.renameFunc(nil)
+	p := newAstPrinter(wr, rename)
+	for _, name := range ng.sortedNames() {
+		decl := ng.decls[name]
+		mangled := ng.mangled[name]
+		if typedefs.Contains(mangled) || ng.shared.Contains(name) {
+			continue
+		}
+		typedefs.Add(mangled)
+		copied := declKind(decl) + " " + name
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			p.println(decl)
+		case *ast.TypeSpec:
+			p.println(&ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{decl}})
+			*origins = append(*origins, printOrigin{pk, decl.Pos(), nil, mangled, copied})
+			for _, f := range pk.types[name].methods {
+				p.println(f)
+				*origins = append(*origins, printOrigin{pk, f.Pos(), nil, mangled, copied})
+			}
+			continue
+		case *ast.ValueSpec:
+			for _, id := range decl.Names {
+				typedefs.Add(ng.mangled[id.Name])
+			}
+			p.println(&ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{decl}})
+		}
+		*origins = append(*origins, printOrigin{pk, decl.Pos(), nil, mangled, copied})
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package typeinst
 
 import (
 	"go/ast"
@@ -15,7 +15,7 @@ import (
 // This file contains no real test, just various experiments (which should pass nicely)
 
 func TestPkgDef(t *testing.T) {
-	impl := newImpl("", "")
+	impl := NewImpl("", "")
 	impl.Package("github.com/dlepex/typeinst/testdata/test", Imports{})
 	for k, p := range impl.pkg {
 		t.Logf("%v # %v ## %s", k, p.typevars, p.types)
@@ -23,7 +23,7 @@ func TestPkgDef(t *testing.T) {
 }
 
 func TestWriteFile(t *testing.T) {
-	impl := newImpl("", "")
+	impl := NewImpl("", "")
 	pk, err := impl.Package("github.com/dlepex/typeinst/testdata/g/maps", Imports{})
 	ce(t, err)
 	pk1, err := impl.Package("github.com/dlepex/typeinst/testdata/g/slices/filter", Imports{})
@@ -53,7 +53,7 @@ func TestWriteFile(t *testing.T) {
 }
 
 func xTestPkgInst(t *testing.T) {
-	impl := newImpl("", "")
+	impl := NewImpl("", "")
 	pd, err := impl.Package("github.com/dlepex/typeinst/testdata/test", Imports{})
 	if err != nil {
 		t.Error(err)
@@ -141,7 +141,7 @@ func ce(t *testing.T, err error) {
 }
 
 func TestDsl(t *testing.T) {
-	dsl, err := ParseDSL("/Users/dlepex/dev/go/work/src/github.com/dlepex/typeinst/testdata/usage/case1.go", "")
+	dsl, err := ParseDSL("testdata/usage/case1.go", "")
 	ce(t, err)
 
 	for _, it := range dsl.Items {
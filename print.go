@@ -1,13 +1,19 @@
-package main
+package typeinst
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
 	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
 	"go/token"
-	"os"
+	"io"
+	"io/ioutil"
+	"log"
 
 	pri "github.com/dlepex/typeinst/internal/printer"
+	"github.com/dlepex/typeinst/internal/sets"
 )
 
 const preambleComment = `// This file was generated by typeinst. Do not edit, use "go generate" instead.
@@ -15,13 +21,14 @@ const preambleComment = `// This file was generated by typeinst. Do not edit, us
 
 type astPrinter struct {
 	pri.Config
-	w    *bufio.Writer
+	w    io.Writer
 	fset *token.FileSet
 }
 
-func newAstPrinter(w *bufio.Writer, rf pri.RenameFunc) *astPrinter {
+func newAstPrinter(w io.Writer, rf pri.RenameFunc) *astPrinter {
 	return &astPrinter{pri.Config{
-		Mode:       pri.UseSpaces,
+		Mode:       pri.UseSpaces | pri.TabIndent, // the same settings as gofmt
+		Tabwidth:   8,
 		RenameFunc: rf,
 	}, w, token.NewFileSet()}
 }
@@ -31,29 +38,123 @@ func (p *astPrinter) println(node interface{}) {
 	if err != nil {
 		bpan.Panicf("Print AST error (%v) for node: %v", err, node)
 	}
-	_, err = p.w.WriteString("\n\n")
+	_, err = io.WriteString(p.w, "\n\n")
 	if err != nil {
 		bpan.Panicf("Writer error: %v", err)
 	}
 }
 
-// Print prints impl to file
-func (im *Impl) Print() (err error) {
-	f, err := os.Create(im.outputFile)
+// Print prints impl to file, the file is left untouched if its content is unchanged or if printing fails
+func (im *Impl) Print() error {
+	b, err := im.Bytes()
 	if err != nil {
 		return err
 	}
+	return im.write(b)
+}
+
+func (im *Impl) write(b []byte) error {
+	return writeIfChanged(im.outputFile, b, im.log)
+}
+
+func writeIfChanged(filename string, b []byte, l *log.Logger) error {
+	if old, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(old, b) {
+		logf(l, "unchanged: %s", filename)
+		return nil
+	}
+	return writeFileAtomic(filename, b)
+}
+
+// Bytes prints impl to memory, the result is gofmt-ed
+func (im *Impl) Bytes() ([]byte, error) {
+	return formatGenerated(im.outputFile, im.Fprint)
+}
+
+// formatGenerated gofmt-s the output of fprint and removes unused imports from it
+func formatGenerated(filename string, fprint func(io.Writer) error) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := fprint(buf); err != nil {
+		return nil, err
+	}
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, formatError(filename, buf.Bytes(), err)
+	}
+	return pruneImports(b)
+}
+
+// pruneImports removes unused imports from (gofmt-ed) src:
+// the imports of generic packages are merged, but only some of their types are instantiated, see TestGeneratedImports.
+func pruneImports(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	used := sets.NewStrSet()
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+				used.Add(id.Name)
+			}
+		}
+		return true
+	})
+	changed := false
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			specs := gd.Specs[:0]
+			for _, spec := range gd.Specs {
+				if n := importSpecName(spec.(*ast.ImportSpec)); n == "_" || used.Contains(n) {
+					specs = append(specs, spec)
+				}
+			}
+			changed = changed || len(specs) != len(gd.Specs)
+			gd.Specs = specs
+			if len(specs) == 0 {
+				continue
+			}
+		}
+		decls = append(decls, decl)
+	}
+	if !changed {
+		return src, nil
+	}
+	f.Decls = decls
+	f.Imports = nil
+	buf := &bytes.Buffer{}
+	if err := format.Node(buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatError points to the line of generated (unformatted) src that cannot be parsed
+func formatError(filename string, src []byte, err error) error {
+	el, ok := err.(scanner.ErrorList)
+	if !ok || len(el) == 0 {
+		return fmt.Errorf("%s: generated code cannot be formatted: %v", filename, err)
+	}
+	pos := el[0].Pos
+	line := ""
+	if lines := bytes.Split(src, []byte("\n")); pos.Line > 0 && pos.Line <= len(lines) {
+		line = string(bytes.TrimSpace(lines[pos.Line-1]))
+	}
+	return fmt.Errorf("%s:%d:%d: generated code does not parse: %s (line: %q)", filename, pos.Line, pos.Column, el[0].Msg, line)
+}
+
+// Fprint prints impl to w
+func (im *Impl) Fprint(w io.Writer) (err error) {
 	defer bpan.RecoverTo(&err)
-	defer func() { err = f.Close() }()
-	wr := bufio.NewWriter(f)
-	defer func() { err = wr.Flush() }()
-	fmt.Fprintf(wr, "%s\npackage %s\n\n", preambleComment, im.pkgName)
+	fmt.Fprintf(w, "%s\npackage %s\n\n", preambleComment, im.pkgName)
 	if !im.imports.IsEmpty() {
-		newAstPrinter(wr, nil).println(im.imports.decl())
+		newAstPrinter(w, nil).println(im.imports.decl())
 	}
-	typedefs := NewStrSet()
-	for _, p := range im.pkg {
-		p.print(wr, typedefs)
+	typedefs := sets.NewStrSet()
+	im.origins = im.origins[:0]
+	for _, path := range im.pkgOrder {
+		im.pkg[path].print(w, typedefs, &im.origins)
 	}
 	return
 }
@@ -66,11 +167,38 @@ func (td *TypeDesc) printedName(n string) string {
 	return n + "Type"
 }
 
-func (pk *PkgDesc) renameFunc(args *TypeArgs, inCtor bool) pri.RenameFunc {
+// newPrinter returns printer of the code of pk instantiated with args, rf renames its identifiers
+func (pk *PkgDesc) newPrinter(w io.Writer, rf pri.RenameFunc, args *TypeArgs) *astPrinter {
+	p := newAstPrinter(w, rf)
+	p.Unqualify = pk.unqualifyFunc(args)
+	return p
+}
+
+// unqualifyFunc reports the members of imported generic packages which are substituted by instances (see foreignName),
+// the printer drops their qualifiers
+func (pk *PkgDesc) unqualifyFunc(args *TypeArgs) pri.UnqualifyFunc {
+	return func(sel *ast.SelectorExpr) bool {
+		s, ok := pk.occForeign[sel.Sel]
+		return ok && s == sel && pk.foreignName(sel, args) != ""
+	}
+}
+
+func (pk *PkgDesc) renameFunc(args *TypeArgs) pri.RenameFunc {
 
 	stringer := astStringer{}
 	return func(id *ast.Ident) string {
 		n := id.Name
+		if pk.nonGen != nil && pk.copyNonGen {
+			if m, ok := pk.nonGen.occ[id]; ok {
+				return m
+			}
+		}
+		if sel, ok := pk.occForeign[id]; ok && id == sel.Sel {
+			// qualifier of substituted member is dropped, see unqualifyFunc()
+			if name := pk.foreignName(sel, args); name != "" {
+				return name
+			}
+		}
 		if pk.occTypes.Contains(id) {
 			t := pk.types[n]
 			if t.isTypevar {
@@ -85,10 +213,10 @@ func (pk *PkgDesc) renameFunc(args *TypeArgs, inCtor bool) pri.RenameFunc {
 			v := pk.consts[n]
 			return stringer.ToString(v)
 		}
-		if inCtor {
-			if pk.occCtors.Contains(id) {
-				t := pk.ctors[n]
-				instName := t.inst[args]
+		if pk.occCtors.Contains(id) {
+			// ctor is renamed if its type is instantiated with args (e.g. in bodies of dependent types)
+			t := pk.ctors[n]
+			if instName, ok := t.inst[args]; ok {
 				return MangleCtorName(n, t.name(), instName)
 			}
 		}
@@ -124,38 +252,55 @@ func (td *TypeDesc) decl(instName string) []*ast.GenDecl {
 	return []*ast.GenDecl{gd, vd}
 }
 
-func (pk *PkgDesc) print(wr *bufio.Writer, typedefs StrSet) {
-	for _, tp := range pk.types {
+// printOrigin describes generic declaration which produced top-level declaration of generated file
+type printOrigin struct {
+	pkg      *PkgDesc
+	pos      token.Pos // position of generic declaration
+	args     *TypeArgs
+	instName string
+	copied   string // copy mode: kind and name of copied non-generic declaration e.g. "func describe"
+}
+
+func (pk *PkgDesc) print(wr io.Writer, typedefs sets.StrSet, origins *[]printOrigin) {
+	for _, tp := range pk.sortedTypes() {
 		if !tp.isVisited {
 			continue
 		}
 		if tp.isGeneric() {
 			isFunc := tp.isSingleFunc()
-			for typeArgs, instName := range tp.inst {
-				p := newAstPrinter(wr, pk.renameFunc(typeArgs, false))
+			for _, typeArgs := range tp.instOrder {
+				instName := tp.inst[typeArgs]
+				p := pk.newPrinter(wr, pk.renameFunc(typeArgs), typeArgs)
 				if !typedefs.Contains(instName) {
 					// instName is printed once (this is how "merged" types work)
 					if !isFunc {
 						for _, d := range tp.decl(instName) {
 							p.println(d)
+							*origins = append(*origins, printOrigin{pk, tp.spec.Pos(), typeArgs, instName, ""})
 						}
 					}
 					typedefs.Add(instName)
 				}
 				if len(tp.ctors) > 0 {
-					p := newAstPrinter(wr, pk.renameFunc(typeArgs, true))
+					p := pk.newPrinter(wr, pk.renameFunc(typeArgs), typeArgs)
 					for _, f := range tp.ctors {
 						p.println(f)
+						*origins = append(*origins, printOrigin{pk, f.Pos(), typeArgs, instName, ""})
 					}
 				}
 				for _, f := range tp.methods {
 					if isFunc {
-						f.Recv = nil
-						f.Name = &ast.Ident{Name: instName}
+						// AST is shared by Impls of the session, so it is never modified
+						fc := *f
+						fc.Recv = nil
+						fc.Name = &ast.Ident{Name: instName}
+						f = &fc
 					}
 					p.println(f)
+					*origins = append(*origins, printOrigin{pk, f.Pos(), typeArgs, instName, ""})
 				}
 			}
 		}
 	}
+	pk.printNonGeneric(wr, typedefs, origins)
 }
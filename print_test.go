@@ -0,0 +1,28 @@
+package typeinst
+
+import (
+	"go/format"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatError(t *testing.T) {
+	src := []byte("package p\n\nfunc f() {\n\tx := \n}\n")
+	_, err := format.Source(src)
+	err = formatError("p_ti.go", src, err)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "p_ti.go:5:1: generated code does not parse")
+	assert.Contains(t, err.Error(), `"}"`)
+}
+
+func TestPruneImports(t *testing.T) {
+	src := []byte("package p\n\nimport (\n\tfmt \"fmt\"\n\tlog \"log\"\n)\n\nfunc f() {\n\tfmt.Println()\n}\n")
+	b, err := pruneImports(src)
+	assert.NoError(t, err)
+	assert.Equal(t, "package p\n\nimport (\n\tfmt \"fmt\"\n)\n\nfunc f() {\n\tfmt.Println()\n}\n", string(b))
+	src = []byte("package p\n\nimport (\n\tlog \"log\"\n)\n\nfunc f() {\n}\n")
+	b, err = pruneImports(src)
+	assert.NoError(t, err)
+	assert.Equal(t, "package p\n\nfunc f() {\n}\n", string(b))
+}
@@ -0,0 +1,130 @@
+package typeinst
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Session shares resolved package dirs and parsed generic packages between Impls (i.e. generated files),
+// Impls of the same session may be processed concurrently.
+type Session struct {
+	mu     sync.Mutex
+	dirs   map[dirKey]string     // generic package -> dir
+	parsed map[string]*parsedDir // dir -> parse result
+}
+
+// dirKey identifies package dir: the same import path may refer to different dirs in different modules
+// (e.g. modules of multi-module repo may require different versions of generic package)
+type dirKey struct {
+	mod  string // root dir of module (of the output dir which resolves the package), "" outside of modules
+	path string // import path
+}
+
+// moduleRoot returns the dir of go.mod which dir belongs to, or ""
+func moduleRoot(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		if info, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// parsedDir is the read-only result of parser.ParseDir shared by all Impls of a session
+type parsedDir struct {
+	once sync.Once
+	fset *token.FileSet
+	pkgs map[string]*ast.Package
+	err  error
+}
+
+// NewSession creates empty session
+func NewSession() *Session {
+	return &Session{
+		dirs:   make(map[dirKey]string),
+		parsed: make(map[string]*parsedDir),
+	}
+}
+
+// resolvePackages finds dirs of (unquoted) package paths by a single `go list` run in dir,
+// it spares `go list` invocations in Impl.Package()
+func (s *Session) resolvePackages(dir string, paths ...string) error {
+	mod := moduleRoot(dir)
+	s.mu.Lock()
+	var missing []string
+	for _, p := range paths {
+		if _, ok := s.dirs[dirKey{mod, p}]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	s.mu.Unlock()
+	if len(missing) == 0 {
+		return nil
+	}
+	dirs, err := packageDirs(dir, missing...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, d := range dirs {
+		s.dirs[dirKey{mod, p}] = d
+	}
+	return err
+}
+
+// packageDir returns the dir of package path as it is resolved in dir (i.e. in the module of dir)
+func (s *Session) packageDir(dir, path string) (string, error) {
+	key := dirKey{moduleRoot(dir), path}
+	s.mu.Lock()
+	d, ok := s.dirs[key]
+	s.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+	if err := s.resolvePackages(dir, path); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d = s.dirs[key]; d == "" {
+		return "", fmt.Errorf("no such package: %s (go list reported no dir)", path)
+	}
+	return d, nil
+}
+
+// parseDir parses dir (including _test.go files) once per session, the result must not be modified.
+// Receiver type parameters are resolved here, since the AST is shared by Impls after that.
+func (s *Session) parseDir(dir string) (*token.FileSet, map[string]*ast.Package, error) {
+	s.mu.Lock()
+	pd, ok := s.parsed[dir]
+	if !ok {
+		pd = &parsedDir{}
+		s.parsed[dir] = pd
+	}
+	s.mu.Unlock()
+	pd.once.Do(func() {
+		pd.fset = token.NewFileSet()
+		pd.pkgs, pd.err = parser.ParseDir(pd.fset, dir, goFileFilter, parser.ParseComments)
+		for _, pkg := range pd.pkgs {
+			for _, f := range pkg.Files {
+				for _, decl := range f.Decls {
+					if fd, ok := decl.(*ast.FuncDecl); ok {
+						resolveRecvTypeParams(fd)
+					}
+				}
+			}
+		}
+	})
+	return pd.fset, pd.pkgs, pd.err
+}
@@ -0,0 +1,8 @@
+package atomic
+
+import "github.com/dlepex/typeinst/testdata/g/slices/indexof"
+
+//go:generate typeinst -all -tests
+type _typeinst struct { //nolint
+	Ints func(T int) indexof.Slice
+}
@@ -0,0 +1,6 @@
+package atomic
+
+import "testing"
+
+// clashes with the instance of indexof.TestIndexOf for Ints
+func TestIndexOfInts(t *testing.T) {}
@@ -0,0 +1,7 @@
+package atomic
+
+import "github.com/dlepex/typeinst/testdata/g/slices/indexof"
+
+type _typeinst struct { //nolint
+	Floats func(T float64) indexof.Slice
+}
@@ -0,0 +1,14 @@
+package bad
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/maps"
+)
+
+type _typeinst struct { //nolint
+	NoArgs   func() maps.Map
+	NoResult func(K int)
+	Repeated func(K int) (maps.Map, maps.Map)
+	NotFunc  int
+	Good     func(K int, V string) maps.Map
+	Both     func(K int) maps.Map[string, int]
+}
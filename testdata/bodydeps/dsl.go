@@ -0,0 +1,10 @@
+package bodydeps
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/list"
+)
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	Ints func(T int) list.List
+}
@@ -0,0 +1,9 @@
+package bodydeps
+
+func use() (n int) {
+	var l Ints
+	l.Add(1)
+	l.Add(2)
+	l.Each(func(v int) { n += v })
+	return n + l.Reversed()[0]
+}
@@ -0,0 +1,19 @@
+package constraint
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/ord"
+)
+
+type Num int
+
+func (a Num) Less(b Num) bool { return a < b }
+
+type Str string
+
+func (a *Str) Less(b Str) bool { return *a < b }
+
+type _typeinst struct { //nolint
+	Nums func(C Num) ord.Slice
+	Strs func(C Str) ord.Slice
+	Ints func(C int) ord.Slice
+}
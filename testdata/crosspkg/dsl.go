@@ -0,0 +1,15 @@
+package crosspkg
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/graph"
+	"github.com/dlepex/typeinst/testdata/g/set"
+)
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	StrSet   func(E string) set.Set
+	StrGraph func(V string) graph.Graph
+	IntGraph func(V int) graph.Graph
+	// graph.Graph of string is not copied, StrGraph is reused
+	StrWeighted func(V string, W float64) graph.Weighted
+}
@@ -0,0 +1,14 @@
+package crosspkg
+
+func use() bool {
+	g := NewStrGraph()
+	g.AddEdge("a", "b")
+	var s StrSet = g.Adjacent("a")
+	ig := NewIntGraph()
+	ig.AddEdge(1, 2)
+	var is IntGraphSet = ig.Adjacent(1)
+	wg := NewStrWeighted()
+	wg.AddWeightedEdge("a", "b", 0.5)
+	var sg *StrGraph = wg.StrGraph
+	return sg.Adjacent("a").Has("b") && wg.Weight("a", "b") > 0 && s.Has("b") && is.Has(2) && NewIntGraphSet().Len() == 0
+}
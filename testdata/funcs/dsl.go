@@ -0,0 +1,16 @@
+//go:build typeinst
+
+package funcs
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/num"
+)
+
+// generic funcs are not types, so this file is excluded from the build
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	intMax   func(Number int) num.Max
+	MaxFloat func(Number float64) num.MaxOf
+	sumInts  func() num.Sum[int]
+}
@@ -0,0 +1,5 @@
+package funcs
+
+func use() float64 {
+	return MaxFloat(1, 2) + float64(intMax(1, 2)+sumInts([]int{1, 2}))
+}
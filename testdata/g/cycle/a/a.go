@@ -0,0 +1,11 @@
+//go:build typeinst
+
+// nolint
+package a
+
+import "github.com/dlepex/typeinst/testdata/g/cycle/b"
+
+// typevar aliases of a and b refer to each other: it is an import cycle, which is hidden from go list by build tag
+type T = b.U //typeinst: typevar
+
+type List []T
@@ -0,0 +1,2 @@
+// Package a is a generic package, its typevar aliases are excluded from the build (see a.go)
+package a
@@ -0,0 +1,10 @@
+//go:build typeinst
+
+// nolint
+package b
+
+import "github.com/dlepex/typeinst/testdata/g/cycle/a"
+
+type U = a.T //typeinst: typevar
+
+type Set map[U]struct{}
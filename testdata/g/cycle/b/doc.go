@@ -0,0 +1,2 @@
+// Package b is a generic package, its typevar aliases are excluded from the build (see b.go)
+package b
@@ -0,0 +1,57 @@
+// Package graph is a generic package, which depends on generic package set
+package graph
+
+import "github.com/dlepex/typeinst/testdata/g/set"
+
+// V is a typevar, it binds the typevar of set package
+type V = set.E //typeinst: typevar
+
+// Graph with vertices of type V
+type Graph struct {
+	adj map[V]set.Set
+}
+
+// NewGraph creates empty graph
+func NewGraph() *Graph {
+	return &Graph{adj: make(map[V]set.Set)}
+}
+
+// AddEdge adds directed edge a -> b
+func (g *Graph) AddEdge(a, b V) {
+	s, ok := g.adj[a]
+	if !ok {
+		s = set.NewSet()
+		g.adj[a] = s
+	}
+	s.Add(b)
+}
+
+// Adjacent returns the vertices adjacent to a
+func (g *Graph) Adjacent(a V) set.Set {
+	return g.adj[a]
+}
+
+// W is a typevar of edge weights
+type W interface{} //typeinst: typevar
+
+// Weighted is a graph with weighted edges
+type Weighted struct {
+	*Graph
+	weights map[[2]V]W
+}
+
+// NewWeighted creates empty weighted graph
+func NewWeighted() *Weighted {
+	return &Weighted{NewGraph(), make(map[[2]V]W)}
+}
+
+// AddWeightedEdge adds directed edge a -> b of weight w
+func (g *Weighted) AddWeightedEdge(a, b V, w W) {
+	g.AddEdge(a, b)
+	g.weights[[2]V{a, b}] = w
+}
+
+// Weight returns the weight of edge a -> b
+func (g *Weighted) Weight(a, b V) W {
+	return g.weights[[2]V{a, b}]
+}
@@ -0,0 +1,80 @@
+// Package list is a generic package, whose helper types are used only in method bodies
+package list
+
+// T is a typevar
+type T interface{} //typeinst: typevar
+
+// List of T
+type List struct {
+	elems []T
+}
+
+// Add appends v
+func (l *List) Add(v T) {
+	l.elems = append(l.elems, v)
+}
+
+// Reversed returns elements in reverse order
+func (l *List) Reversed() []T {
+	var st stack
+	for _, v := range l.elems {
+		st.push(v)
+	}
+	var res []T
+	for v, ok := st.pop(); ok; v, ok = st.pop() {
+		res = append(res, v)
+	}
+	return res
+}
+
+// Each calls f for each element
+func (l *List) Each(f func(T)) {
+	for it := newIter(l); it.next(); {
+		f(it.cur)
+	}
+}
+
+// Empty reports whether the list has no elements
+func (l *List) Empty() bool {
+	return !newIter(l).next() // ctor call is the operand of selector
+}
+
+type stack struct {
+	top *node
+}
+
+type node struct {
+	v    T
+	next *node
+}
+
+func (s *stack) push(v T) {
+	s.top = &node{v, s.top}
+}
+
+func (s *stack) pop() (v T, ok bool) {
+	if s.top == nil {
+		return v, false
+	}
+	v, s.top = s.top.v, s.top.next
+	return v, true
+}
+
+type iter struct {
+	l   *List
+	i   int
+	cur T
+}
+
+func newIter(l *List) *iter {
+	return &iter{l: l}
+}
+
+func (it *iter) next() bool {
+	if it.i >= len(it.l.elems) {
+		return false
+	}
+	it.cur = it.l.elems[it.i]
+	it.i++
+	return true
+}
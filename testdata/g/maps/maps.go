@@ -51,3 +51,14 @@ func makeWrappers() []*wrapper {
 func makeWrappers99() []**[maxW]*[]wrapper {
 	return nil
 }
+
+// Keys depends on typevar V only through the generic func it calls
+type Keys []K
+
+func (ks Keys) Len() int {
+	return countValues(nil) + len(ks)
+}
+
+func countValues(vs []V) int {
+	return len(vs)
+}
@@ -0,0 +1,36 @@
+// Package nongen is a generic package with non-generic code
+package nongen
+
+import "fmt"
+
+// T is a typevar
+type T interface{} //typeinst: typevar
+
+// Stack of T
+type Stack []T
+
+// Push pushes v
+func (s *Stack) Push(v T) {
+	*s = append(*s, v)
+	pushes++
+}
+
+func (s Stack) String() string {
+	return describe(len(s))
+}
+
+var pushes int
+
+type counter struct{ n int }
+
+func (c *counter) inc() { c.n++ }
+
+const suffix = "!"
+
+func describe(n int) string {
+	var c counter
+	c.inc()
+	return fmt.Sprintf("stack of %d%s %d", n, suffix, c.n)
+}
+
+func unused() {}
@@ -0,0 +1,37 @@
+package num
+
+// Number is substituted by numeric types
+type Number int //typeinst: typevar
+
+// Max returns the greater of a and b
+func Max(a, b Number) Number {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// MaxOf returns the greatest of a, or zero if a is empty
+func MaxOf(a ...Number) (m Number) {
+	for i, v := range a {
+		if i == 0 {
+			m = v
+		}
+		m = Max(m, v)
+	}
+	return
+}
+
+// Sum returns the sum of a
+func Sum(a []Number) Number {
+	var s Number
+	for _, v := range a {
+		s += v
+	}
+	return s
+}
+
+// Half does not depend on Number, so it is not generic
+func Half(a int) int {
+	return a / 2
+}
@@ -0,0 +1,17 @@
+package ord
+
+type C interface { //typeinst: typevar
+	Less(C) bool
+}
+
+type Slice []C
+
+func (a Slice) Max() C {
+	m := a[0]
+	for _, v := range a[1:] {
+		if m.Less(v) {
+			m = v
+		}
+	}
+	return m
+}
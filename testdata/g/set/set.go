@@ -0,0 +1,29 @@
+// Package set is a generic package, it is used by another generic package (graph)
+package set
+
+// E is a typevar
+type E interface{} //typeinst: typevar
+
+// Set of E
+type Set map[E]struct{}
+
+// NewSet creates empty set
+func NewSet() Set {
+	return make(Set)
+}
+
+// Add adds e to the set
+func (s Set) Add(e E) {
+	s[e] = struct{}{}
+}
+
+// Has reports whether e is in the set
+func (s Set) Has(e E) bool {
+	_, ok := s[e]
+	return ok
+}
+
+// Len is the size of the set
+func (s Set) Len() int {
+	return len(s)
+}
@@ -0,0 +1,31 @@
+package indexof
+
+import (
+	"testing"
+)
+
+func TestIndexOf(t *testing.T) {
+	var zero T
+	a := NewSlice().AppendUniq(zero).AppendUniq(zero)
+	if len(a) != 1 || a.IndexOf(zero) != 0 {
+		t.Errorf("AppendUniq/IndexOf failed: %v", a)
+	}
+	checkContains(t, &a, zero)
+	if !eq(a[0], zero) {
+		t.Errorf("eq(%v, %v) failed", a[0], zero)
+	}
+}
+
+func eq(a, b T) bool {
+	return a == b
+}
+
+func checkContains(t *testing.T, a *Slice, el T) {
+	if !a.Contains(el) {
+		t.Errorf("Contains(%v) failed", el)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	Empty()
+}
@@ -0,0 +1,50 @@
+// Package typeparams is a generic package which uses Go 1.18 type parameters together with typeinst typevars
+package typeparams
+
+// K is a typevar
+type K = any
+
+// Map is generic over K (typevar) and V (type parameter)
+type Map[V any] map[K]V
+
+func NewMap[V any]() Map[V] {
+	return make(Map[V])
+}
+
+func (m Map[V]) Keys() []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Values uses receiver type parameter named K, which shadows the typevar
+func (m Map[K]) Values() []K {
+	vals := make([]K, 0, len(m))
+	for _, v := range m {
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+// Acc accumulates numbers by key
+type Acc[N ~int | ~int64 | ~float64, E interface{ comparable }] struct {
+	Key  K
+	Sum  N
+	Seen map[E]struct{}
+}
+
+func NewAcc[N ~int | ~int64 | ~float64, E comparable](key K) *Acc[N, E] {
+	return &Acc[N, E]{Key: key, Seen: map[E]struct{}{}}
+}
+
+func (a *Acc[N, E]) Add(e E, n N) {
+	if _, ok := a.Seen[e]; !ok {
+		a.Seen[e] = struct{}{}
+		a.Sum += n
+	}
+}
+
+// Ptrs requires trailing comma in type parameter list
+type Ptrs[P *K,] []P
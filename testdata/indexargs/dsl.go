@@ -0,0 +1,18 @@
+//go:build typeinst
+
+package indexargs
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/maps"
+	"github.com/dlepex/typeinst/testdata/g/slices/indexof"
+)
+
+// type arguments are bound to typevars in the order of their declaration: maps.K, maps.V
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	StrIntMap    func() maps.Map[string, int]
+	FloatTreeMap maps.TreeMap[float64, float64]
+	Strs         func() indexof.Slice[string]
+	StrKeys      func() maps.Keys[string, int]
+}
@@ -0,0 +1,8 @@
+package indexargs
+
+func use() (int, *FloatTreeMap) {
+	m := StrIntMap{"a": 1}
+	var keys []string
+	m.KeyValues(&keys, nil)
+	return NewStrs().AppendUniq("a").IndexOf(keys[0]), nil
+}
@@ -0,0 +1,7 @@
+package local
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	IntSet func(E int) Set
+	StrSet func(E string) Set
+}
@@ -0,0 +1,11 @@
+package local
+
+//typeinst:template
+
+type E = interface{}
+
+type Set map[E]struct{}
+
+func NewSet() Set { return make(Set) }
+
+func (s Set) Add(e E) { s[e] = struct{}{} }
@@ -0,0 +1,2 @@
+// Package localtag contains local generic types excluded from the build by "typeinst" tag.
+package localtag
@@ -0,0 +1,22 @@
+//go:build typeinst
+// +build typeinst
+
+package localtag
+
+type T = interface{} //typeinst: typevar
+
+type Stack []T
+
+func (s *Stack) Push(v T) { *s = append(*s, v) }
+
+func (s *Stack) Pop() T {
+	a := *s
+	v := a[len(a)-1]
+	*s = a[:len(a)-1]
+	return v
+}
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	IntStack func(T int) Stack
+}
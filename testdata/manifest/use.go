@@ -0,0 +1,10 @@
+package manifest
+
+import "time"
+
+func use() int {
+	m := Durations{"a": time.Second}
+	var keys []string
+	m.KeyValues(&keys, nil)
+	return NewStrs().AppendUniq("a").IndexOf(keys[0])
+}
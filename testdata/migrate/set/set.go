@@ -0,0 +1,87 @@
+// Package set is a typeinst generic package, it is migrated by TestMigrate
+package set
+
+import "fmt"
+
+// E is a typevar
+type E = interface{}
+
+// Set of E
+type Set map[E]struct{}
+
+func NewSet(elems ...E) Set {
+	s := make(Set)
+	for _, e := range elems {
+		s.Add(e)
+	}
+	return s
+}
+
+func (s Set) Add(e E) {
+	s[e] = struct{}{}
+}
+
+func (s Set) Contains(e E) bool {
+	_, ok := s[e]
+	return ok
+}
+
+// List is an ordered Set
+type List struct {
+	set   Set
+	elems []E
+}
+
+func NewList() *List {
+	return &List{set: NewSet()}
+}
+
+func (l *List) Add(e E) {
+	if !l.set.Contains(e) {
+		l.set.Add(e)
+		l.elems = append(l.elems, e)
+	}
+}
+
+func (l *List) String() string {
+	return fmt.Sprint(l.elems)
+}
+
+// V is a typevar
+type V = interface{}
+
+// Map values
+type Values []V
+
+func (vs Values) Uniq() Values {
+	seen := map[string]bool{}
+	var res Values
+	for _, v := range vs {
+		if k := fmt.Sprint(v); !seen[k] {
+			seen[k] = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Count is a generic func (ESGT)
+type Count struct{}
+
+func (Count) Apply(s Set, vs ...E) (n int) {
+	for _, v := range vs {
+		if s.Contains(v) {
+			n++
+		}
+	}
+	return n
+}
+
+func nonGeneric() string {
+	return "non-generic"
+}
+
+// Has is a generic func
+func Has(s Set, e E) bool {
+	return s.Contains(e)
+}
@@ -0,0 +1,14 @@
+//go:build typeinst
+
+package use
+
+import "example.com/migrate/set"
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	StrSet   func(E string) set.Set
+	IntList  func(E int) set.List
+	Floats   func(V float64) set.Values
+	countStr func(E string) set.Count
+	hasStr   func(E string) set.Has
+}
@@ -0,0 +1,11 @@
+package use
+
+// Use uses the types declared by dsl-struct, its code is not changed by migration
+func Use() (bool, string, int, int, bool) {
+	s := NewStrSet("a", "b")
+	l := NewIntList()
+	l.Add(1)
+	l.Add(1)
+	var fs Floats = []float64{1, 1, 2}
+	return s.Contains("a"), l.String(), len(fs.Uniq()), countStr(s, "a", "c"), hasStr(s, "b")
+}
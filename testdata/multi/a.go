@@ -0,0 +1,16 @@
+package multi
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/slices/filter"
+	"github.com/dlepex/typeinst/testdata/g/slices/indexof"
+)
+
+//go:generate typeinst
+type _typeinstCollections struct { //nolint
+	Ints func(T int) indexof.Slice
+}
+
+// output file is set explicitly (by the line comment, gofmt would reformat it in the doc comment)
+type _typeinstFloats struct { //nolint
+	Floats func(T float64) filter.Slice
+} //typeinst: output filters_ti.go
@@ -0,0 +1,9 @@
+package multi
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/slices/indexof"
+)
+
+type _typeinstOther struct { //nolint
+	Strs func(T string) indexof.Slice
+}
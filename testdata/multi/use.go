@@ -0,0 +1,7 @@
+package multi
+
+// use refers to the outputs of several dsl-structs of the package
+func use() bool {
+	positive := func(f float64) bool { return f > 0 }
+	return Ints{1}.IndexOf(1) == 0 && len(Floats{-1, 1}.FilterInplace(positive)) == 1
+}
@@ -0,0 +1,15 @@
+package nongen
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/nongen"
+)
+
+//go:generate typeinst -copy
+type _typeinst struct { //nolint
+	IntStack func(T int) nongen.Stack
+}
+
+// the other output of the package: copied code is shared with dsl_ti.go
+type _typeinstMore struct { //nolint
+	StrStack func(T string) nongen.Stack
+}
@@ -0,0 +1,7 @@
+package nongen
+
+func use() string {
+	var s IntStack
+	s.Push(1)
+	return s.String()
+}
@@ -0,0 +1,12 @@
+package nongen2
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/nongen"
+)
+
+// a_ti.go and strs_ti.go (of b.go) are generated by separate runs, but they share copied code
+
+//go:generate typeinst -copy
+type _typeinst struct { //nolint
+	IntStack func(T int) nongen.Stack
+}
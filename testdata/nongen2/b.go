@@ -0,0 +1,10 @@
+package nongen2
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/nongen"
+)
+
+//go:generate typeinst -copy
+type _typeinstStrs struct { //nolint
+	StrStack func(T string) nongen.Stack
+}
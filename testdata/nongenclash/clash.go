@@ -0,0 +1,4 @@
+package nongenclash
+
+// clashes with the copy of nongen.describe
+func nongenDescribe() {}
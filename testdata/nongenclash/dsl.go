@@ -0,0 +1,10 @@
+package nongenclash
+
+import (
+	"github.com/dlepex/typeinst/testdata/g/nongen"
+)
+
+//go:generate typeinst -copy
+type _typeinst struct { //nolint
+	IntStack func(T int) nongen.Stack
+}
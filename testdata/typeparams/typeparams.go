@@ -0,0 +1,14 @@
+//go:build typeinst
+
+package typeparams
+
+import "github.com/dlepex/typeinst/testdata/g/typeparams"
+
+// dsl-struct refers to generic types w/o type arguments, so the file is excluded from the build
+
+//go:generate typeinst
+type _typeinst struct { //nolint
+	StrMap  func(K string) typeparams.Map
+	IntAcc  func(K int) typeparams.Acc
+	IntPtrs func(K int) typeparams.Ptrs
+}
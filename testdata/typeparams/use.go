@@ -0,0 +1,11 @@
+package typeparams
+
+func use() (int, []string, []float64) {
+	m := NewStrMap[float64]()
+	m["a"] = 1
+	a := NewIntAcc[int, string](1)
+	a.Add("x", 1)
+	a.Add("x", 2)
+	var _ IntPtrs[*int]
+	return a.Sum, m.Keys(), m.Values()
+}
@@ -0,0 +1,10 @@
+package verify
+
+import (
+	"github.com/dlepex/genericlib/set"
+)
+
+type _typeinst struct { //nolint
+	StrSet  func(E string) set.Set
+	FuncSet func(E func()) set.Set
+}
@@ -1,61 +1,344 @@
-package main
+// Package typeinst generates instantiations of generic types (packages with interface{} typevars) into a Go file.
+//
+// The command line tool is cmd/typeinst, RunOptions() and RunPackages() do the same as the tool.
+// Generated file can also be built programmatically, with or without DSL:
+//
+//	impl := typeinst.NewImpl("dsl_ti.go", "mypkg")
+//	dsl, err := typeinst.ParseDSL("dsl.go", typeinst.DefaultStructName)
+//	err = impl.AddDSL(dsl)
+//	err = impl.Instantiate("example.com/maps", "Map", "StrMap", map[string]string{"K": "string", "V": "string"})
+//	err = impl.Resolve()
+//	b, err := impl.Bytes() // or impl.Fprint(w), impl.Print()
+package typeinst
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+
+	"github.com/dlepex/typeinst/internal/sets"
 )
 
-const fileSuffix = "_ti" // generated file suffix
+// FileSuffix is the default suffix of generated files
+const FileSuffix = "_ti"
+
+// Options - parameters of a single typeinst run, see the command line flags of cmd/typeinst
+type Options struct {
+	File       string      // file with dsl-struct, or manifest (.json)
+	StructName string      // dsl-struct name (prefix)
+	Output     string      // generated file, if empty it is derived from File and Suffix
+	Suffix     string      // generated file suffix
+	PkgName    string      // generated package name, if empty the package of dsl-struct is used
+	Check      bool        // check mode: compare generated code with the existing file, never write it
+	Verify     bool        // type-check generated code together with the target package before writing it (off in zero Options, the tool turns it on by default)
+	AllFiles   bool        // process dsl-structs of all files in the package of File
+	Tests      bool        // instantiate tests (_test.go files) of generic packages too
+	Copy       bool        // copy non-generic code used by generic code into generated file, instead of reporting it
+	Logger     *log.Logger // progress messages and warnings are written to Logger, nil means silent
+	Diff       io.Writer   // check mode: diffs of stale files (and files to be removed by Migrate) are written to Diff, nil means discard
+}
+
+// ErrStale is returned in check mode if the generated file is missing or out of date
+var ErrStale = errors.New("generated file is out of date, run go generate")
 
-func main() {
-	gofile := os.Getenv("GOFILE")
-	fmt.Printf("$GOPATH = %v\n$GOFILE = %v\n", os.Getenv("GOPATH"), gofile)
-	fatalIfErr(Run(gofile))
+// Run generates implementation file for the dsl-struct of gofile with default options.
+func Run(gofile string) error {
+	return RunOptions(Options{File: gofile})
+}
+
+// RunOptions generates implementation file according to opts
+func RunOptions(opts Options) (err error) {
+	defer bpan.RecoverTo(&err)
+	if opts.Suffix == "" {
+		opts.Suffix = FileSuffix
+	}
+	if opts.StructName == "" {
+		opts.StructName = DefaultStructName
+	}
+	if ext := filepath.Ext(opts.File); ext == ".yaml" || ext == ".yml" {
+		return fmt.Errorf("%s: YAML manifests are not supported, use JSON", opts.File)
+	}
+	if isManifest(opts.File) {
+		dsl, err := ParseManifest(opts.File)
+		if err != nil {
+			return err
+		}
+		return runDSLs(opts, []*DSL{dsl})
+	}
+	files := []string{opts.File}
+	if opts.AllFiles {
+		files, err = packageFiles(opts.File)
+		bpan.Check(err)
+	}
+	var errs ErrorList
+	var dsls []*DSL
+	for _, f := range files {
+		d, err := ParseDSLs(f, opts.StructName)
+		if !opts.AllFiles || !errors.Is(err, ErrDSLNotFound) {
+			errs.Add(err)
+		}
+		dsls = append(dsls, d...)
+	}
+	if len(dsls) == 0 && len(errs) == 0 {
+		return fmt.Errorf("%v: %s in package of %s", ErrDSLNotFound, opts.StructName, opts.File)
+	}
+	if opts.Output != "" && len(dsls) > 1 {
+		return fmt.Errorf("output file can be set only for a single dsl-struct, found: %d", len(dsls))
+	}
+	errs.Add(runDSLs(opts, dsls))
+	return errs.Err()
 }
 
-// Run - convenience func for tests.
-func Run(gofile string) (err error) {
+// RunPackages generates implementation files for all dsl-structs found in packages matching patterns (e.g. ./...)
+func RunPackages(opts Options, patterns ...string) (err error) {
 	defer bpan.RecoverTo(&err)
-	implFile := implFilename(gofile, fileSuffix)
-	dsl, err := ParseDSL(gofile, "")
+	if opts.Output != "" {
+		return fmt.Errorf("output file cannot be set for package patterns")
+	}
+	if opts.StructName == "" {
+		opts.StructName = DefaultStructName
+	}
+	pkgs, err := goList(".", nil, patterns...)
 	bpan.Check(err)
-	impl := newImpl(implFile, dsl.PkgName)
-	dsl2Impl(dsl, impl)
-	return
+	var errs ErrorList
+	var dsls []*DSL
+	for _, p := range pkgs {
+		if p.Error != nil {
+			errs.Addf("%s: %s", p.ImportPath, p.Error.Err)
+			continue
+		}
+		// ignored files may contain local generic types and dsl-structs, see isTemplateFile()
+		for _, name := range append(p.GoFiles, p.IgnoredGoFiles...) {
+			f := filepath.Join(p.Dir, name)
+			if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || !fileContains(f, opts.StructName) {
+				continue
+			}
+			d, err := ParseDSLs(f, opts.StructName)
+			if !errors.Is(err, ErrDSLNotFound) {
+				errs.Add(err)
+			}
+			dsls = append(dsls, d...)
+		}
+	}
+	logf(opts.Logger, "found %d dsl-structs in %d packages", len(dsls), len(pkgs))
+	errs.Add(runDSLs(opts, dsls))
+	return errs.Err()
 }
 
-func dsl2Impl(dsl *DSL, impl *Impl) {
-	for _, it := range dsl.Items {
-		for _, g := range it.GenericTypes {
-			p, err := impl.Package(g.PkgName, dsl.Imports)
-			bpan.Check(err)
-			log.Printf("dsl: type %s = %s with args: %v", it.InstName, g.Type, it.TypeArgs)
-			bpan.Check(p.Inst(g.Type, it.InstName, it.TypeArgs))
+// runDSLs generates implementation file for each dsl, generic packages are parsed once and shared by the files.
+// Files are generated and verified concurrently, nothing is written unless all of them (and their tests) are verified.
+func runDSLs(opts Options, dsls []*DSL) error {
+	if opts.Suffix == "" {
+		opts.Suffix = FileSuffix
+	}
+	var errs ErrorList
+	session := NewSession()
+	outputs := make(map[string]string)
+	impls := make([]*Impl, 0, len(dsls))
+	implDsls := make([]*DSL, 0, len(dsls))
+	paths := make(map[string]sets.StrSet) // module root -> generic packages used by its dsl-structs
+	modDirs := make(map[string]string)
+	for _, dsl := range dsls {
+		for _, w := range dsl.Warnings {
+			logf(opts.Logger, "%s", w)
+		}
+		implFile := opts.Output
+		if implFile == "" {
+			var err error
+			if implFile, err = dsl.OutputFile(opts.StructName, opts.Suffix); err != nil {
+				errs.Add(err)
+				continue
+			}
+		}
+		if other, has := outputs[implFile]; has {
+			errs.Addf("dsl-structs %s and %s have the same output file: %s", other, dsl.StructName, implFile)
+			continue
+		}
+		outputs[implFile] = dsl.StructName
+		pkgName := opts.PkgName
+		if pkgName == "" {
+			pkgName = dsl.PkgName
+		}
+		impl := NewImpl(implFile, pkgName)
+		impl.session = session
+		impl.withTests = opts.Tests
+		impl.copyNonGen = opts.Copy
+		impl.log = opts.Logger
+		impls = append(impls, impl)
+		implDsls = append(implDsls, dsl)
+		mod := moduleRoot(filepath.Dir(implFile))
+		if paths[mod] == nil {
+			paths[mod] = sets.NewStrSet()
+			modDirs[mod] = filepath.Dir(implFile)
+		}
+		paths[mod].AddMany(dsl.genericPackages()...)
+	}
+	for mod, ps := range paths {
+		// errors are reported by Impl.Package() for each dsl item
+		_ = session.resolvePackages(modDirs[mod], sortedStrs(ps)...)
+	}
+	errs.Add(parallel(len(impls), func(i int) error { return dsl2Impl(implDsls[i], impls[i]) }))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	shareNonGeneric(impls)
+	srcs := make([][]byte, len(impls))
+	testSrcs := make([][]byte, len(impls)) // nil if impl has no tests
+	if err := parallel(len(impls), func(i int) (err error) {
+		logf(opts.Logger, "printing: %s", impls[i].outputFile)
+		if srcs[i], err = impls[i].Bytes(); err != nil {
+			return err
+		}
+		testSrcs[i], err = impls[i].TestBytes()
+		return err
+	}); err != nil {
+		return err
+	}
+	if opts.Check {
+		// diffs are written in order of impls, whichever of them is checked first
+		diffs := make([]bytes.Buffer, len(impls))
+		err := parallel(len(impls), func(i int) error { return checkImpl(&diffs[i], impls[i], srcs[i], testSrcs[i]) })
+		if opts.Diff != nil {
+			for i := range diffs {
+				if _, werr := diffs[i].WriteTo(opts.Diff); werr != nil {
+					return werr
+				}
+			}
 		}
+		return err
 	}
-	for path, pdesc := range impl.pkg {
-		log.Printf("walk: %s", path)
-		bpan.Check(pdesc.resolveGeneric())
+	if opts.Verify {
+		// outputs of the same package are verified together, since they may be missing on disk yet
+		pkgOutputs := make(map[string]map[string][]byte) // dir -> output file -> src
+		for i, impl := range impls {
+			dir := filepath.Dir(impl.outputFile)
+			if pkgOutputs[dir] == nil {
+				pkgOutputs[dir] = make(map[string][]byte)
+			}
+			pkgOutputs[dir][impl.outputFile] = srcs[i]
+			if testSrcs[i] != nil {
+				pkgOutputs[dir][impl.TestOutputFile()] = testSrcs[i]
+			}
+		}
+		if err := parallel(len(impls), func(i int) error {
+			logf(opts.Logger, "verifying: %s", impls[i].outputFile)
+			siblings := pkgOutputs[filepath.Dir(impls[i].outputFile)]
+			if testSrcs[i] != nil {
+				return impls[i].VerifyTests(srcs[i], testSrcs[i], siblings)
+			}
+			return impls[i].Verify(srcs[i], siblings)
+		}); err != nil {
+			return err
+		}
 	}
-	log.Printf("printing...")
-	bpan.Check(impl.Print())
+	return parallel(len(impls), func(i int) error {
+		if err := impls[i].write(srcs[i]); err != nil {
+			return err
+		}
+		if testSrcs[i] != nil {
+			return writeIfChanged(impls[i].TestOutputFile(), testSrcs[i], impls[i].log)
+		}
+		return nil
+	})
 }
 
-func implFilename(p, suf string) string {
-	f := path.Base(p)
-	pos := strings.LastIndex(f, ".go")
-	if pos == -1 {
-		log.Fatal("not a .go file")
+// parallel calls f(0)...f(n-1) concurrently (at most GOMAXPROCS at once), errors are collected in order of i.
+func parallel(n int, f func(i int) error) error {
+	res := make([]ErrorList, n)
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res[i].CatchAt(token.Position{}, func() { res[i].Add(f(i)) })
+		}(i)
 	}
-	f = f[0:pos]
-	return path.Join(path.Dir(p), f+suf+".go")
+	wg.Wait()
+	var errs ErrorList
+	for _, el := range res {
+		errs.Add(el)
+	}
+	return errs.Err()
+}
+
+func fileContains(filename, s string) bool {
+	b, err := ioutil.ReadFile(filename)
+	return err != nil || bytes.Contains(b, []byte(s))
 }
 
-func fatalIfErr(err error) {
+// packageFiles returns .go files (excluding tests) of the package of file
+func packageFiles(file string) ([]string, error) {
+	dir := filepath.Dir(file)
+	fset := token.NewFileSet()
+	pf, err := parser.ParseFile(fset, file, nil, parser.PackageClauseOnly)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return nil, err
+	}
+	m, err := parser.ParseDir(fset, dir, pkgFileFilter, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := m[pf.Name.Name]
+	if !ok {
+		return nil, fmt.Errorf("package %s not found in %s", pf.Name.Name, dir)
+	}
+	return sortedFiles(pkg.Files), nil
+}
+
+// checkImpl compares impl (generated as b, its tests as tb) with its output files, writing unified diff to w in case of mismatch.
+func checkImpl(w io.Writer, impl *Impl, b, tb []byte) error {
+	stale, err := checkFile(w, impl.outputFile, b)
+	if err == nil && tb != nil {
+		var testStale bool
+		testStale, err = checkFile(w, impl.TestOutputFile(), tb)
+		stale = stale || testStale
+	}
+	if err == nil && stale {
+		err = ErrStale
+	}
+	return err
+}
+
+func checkFile(w io.Writer, filename string, b []byte) (stale bool, err error) {
+	old, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if d := unifiedDiff(filename, filename+" (generated)", old, b); d != "" {
+		_, err = io.WriteString(w, d)
+		return true, err
+	}
+	return false, nil
+}
+
+// dsl2Impl instantiates and resolves all dsl items, all errors are collected into ErrorList
+func dsl2Impl(dsl *DSL, impl *Impl) error {
+	var errs ErrorList
+	errs.Add(impl.AddDSL(dsl))
+	errs.Add(impl.Resolve())
+	return errs.Err()
+}
+
+func implFilename(p, suf string) (string, error) {
+	f := path.Base(p)
+	pos := strings.LastIndex(f, ".go")
+	if pos == -1 {
+		return "", fmt.Errorf("not a .go file: %s", p)
 	}
+	f = f[0:pos]
+	return path.Join(path.Dir(p), f+suf+".go"), nil
 }
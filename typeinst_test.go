@@ -1,8 +1,15 @@
-package main
+package typeinst
 
 import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,7 +25,502 @@ func TestUsage(t *testing.T) {
 	}
 }
 
+func TestTests(t *testing.T) {
+	e := RunOptions(Options{File: "testdata/usage/case1.go", Tests: true, Verify: true})
+	assert.NoError(t, e)
+	assert.True(t, pathExists("testdata/usage/case1_ti_test.go"))
+	cmd := exec.Command("go", "test", "github.com/dlepex/typeinst/testdata/usage")
+	b, e := cmd.CombinedOutput()
+	if e != nil {
+		t.Errorf(string(b))
+	}
+}
+
+func TestVerifyBeforeWrite(t *testing.T) {
+	// b_ti.go is fine, but the generated tests of a_ti.go clash with a_test.go: nothing is written
+	err := RunOptions(Options{File: "testdata/atomic/a.go", AllFiles: true, Tests: true, Verify: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "TestIndexOfInts redeclared")
+	}
+	for _, f := range []string{"a_ti.go", "a_ti_test.go", "b_ti.go", "b_ti_test.go"} {
+		assert.False(t, pathExists(filepath.Join("testdata/atomic", f)), f)
+	}
+}
+
 func run(f string) error {
-	p := packagePath(path.Join("github.com/dlepex/typeinst", f))
-	return Run(p)
+	return Run(f)
+}
+
+func TestImplFilename(t *testing.T) {
+	f, err := implFilename("a/b/gen.go", "_ti")
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b/gen_ti.go", f)
+	_, err = implFilename("a/b/gen.txt", "_ti")
+	assert.Error(t, err)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "typeinst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "a_ti.go")
+	assert.NoError(t, writeFileAtomic(f, []byte("package a\n")))
+	assert.NoError(t, writeFileAtomic(f, []byte("package b\n")))
+	b, err := ioutil.ReadFile(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "package b\n", string(b))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestVerify(t *testing.T) {
+	err := RunOptions(Options{File: "testdata/verify/verify.go", Verify: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "testdata/verify/verify_ti.go:")
+	assert.Contains(t, err.Error(), "invalid map key type func()")
+	assert.Contains(t, err.Error(), "set.go:")
+	assert.Contains(t, err.Error(), "dsl-struct field: testdata/verify/verify.go:9:2")
+	assert.False(t, pathExists("testdata/verify/verify_ti.go"))
+}
+
+func TestConstraints(t *testing.T) {
+	err := RunOptions(Options{File: "testdata/constraint/constraint.go", Verify: true})
+	assert.Error(t, err)
+	errs := err.(ErrorList)
+	if assert.Len(t, errs, 2) {
+		// only *Str has method Less
+		assert.Contains(t, errs[0].Error(), "testdata/constraint/constraint.go:17:2: type Str does not implement C: method Less has pointer receiver")
+		assert.Contains(t, errs[1].Error(), "testdata/constraint/constraint.go:18:2: type int does not implement C: missing method Less")
+	}
+	assert.False(t, pathExists("testdata/constraint/constraint_ti.go"))
+	// constraints are checked by Resolve, before (and without) verification
+	err = RunOptions(Options{File: "testdata/constraint/constraint.go"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "testdata/constraint/constraint.go:17:2: type Str does not implement C: method Less has pointer receiver")
+		assert.Contains(t, err.Error(), "testdata/constraint/constraint.go:18:2: type int does not implement C: missing method Less")
+	}
+	assert.False(t, pathExists("testdata/constraint/constraint_ti.go"))
+}
+
+func TestLocalTemplates(t *testing.T) {
+	assert.NoError(t, RunOptions(Options{File: "testdata/local/local.go", Verify: true}))
+	assert.NoError(t, RunOptions(Options{File: "testdata/localtag/stack_gen.go", Verify: true}))
+	cmd := exec.Command("go", "build", "github.com/dlepex/typeinst/testdata/local", "github.com/dlepex/typeinst/testdata/localtag")
+	b, e := cmd.CombinedOutput()
+	if e != nil {
+		t.Errorf(string(b))
+	}
+}
+
+func TestIsTemplateFile(t *testing.T) {
+	for src, want := range map[string]bool{
+		"//go:build typeinst\n\npackage p\n":                       true,
+		"//go:build typeinst && linux\n\npackage p\n":              true,
+		"// +build typeinst\n\npackage p\n":                        true,
+		"//go:build !typeinst\n\npackage p\n":                      false,
+		"//go:build linux || typeinst\n\npackage p\n":              false,
+		"//go:build linux\n\npackage p\n":                          false,
+		"package p\n\n//typeinst:template\n":                       true,
+		"package p\n\n//go:build typeinst\n":                       false,
+		"//go:build !linux && typeinst || typeinst\n\npackage p\n": true,
+	} {
+		f, err := parser.ParseFile(token.NewFileSet(), "p.go", src, parser.ParseComments)
+		if assert.NoError(t, err) {
+			assert.Equal(t, want, isTemplateFile(f), src)
+		}
+	}
+}
+
+func TestMultipleDSL(t *testing.T) {
+	// fresh run: use.go refers to several outputs, which are verified together before any of them is written
+	for _, f := range []string{"collections_ti.go", "filters_ti.go", "other_ti.go"} {
+		_ = os.Remove(filepath.Join("testdata/multi", f))
+	}
+	assert.NoError(t, RunOptions(Options{File: "testdata/multi/a.go", AllFiles: true, Verify: true}))
+	for _, f := range []string{"collections_ti.go", "filters_ti.go", "other_ti.go"} {
+		assert.True(t, pathExists(filepath.Join("testdata/multi", f)), f)
+	}
+	cmd := exec.Command("go", "build", "github.com/dlepex/typeinst/testdata/multi")
+	b, e := cmd.CombinedOutput()
+	if e != nil {
+		t.Errorf(string(b))
+	}
+	dsls, err := ParseDSLs("testdata/multi/a.go", "")
+	assert.NoError(t, err)
+	assert.Len(t, dsls, 2)
+
+	// check mode: diffs are written in order of dsl-structs
+	diff := &bytes.Buffer{}
+	assert.NoError(t, RunOptions(Options{File: "testdata/multi/a.go", AllFiles: true, Check: true, Diff: diff}))
+	assert.Empty(t, diff.String())
+	for _, f := range []string{"collections_ti.go", "other_ti.go"} {
+		assert.NoError(t, os.Remove(filepath.Join("testdata/multi", f)))
+	}
+	err = RunOptions(Options{File: "testdata/multi/a.go", AllFiles: true, Check: true, Diff: diff})
+	assert.EqualError(t, err, ErrStale.Error())
+	collections := strings.Index(diff.String(), "+++ testdata/multi/collections_ti.go (generated)\n")
+	other := strings.Index(diff.String(), "+++ testdata/multi/other_ti.go (generated)\n")
+	assert.True(t, collections >= 0 && other > collections, diff.String())
+	assert.NotContains(t, diff.String(), "filters_ti.go")
+	assert.False(t, pathExists("testdata/multi/collections_ti.go"))
+	assert.NoError(t, RunOptions(Options{File: "testdata/multi/a.go", AllFiles: true}))
+}
+
+func TestRunPackages(t *testing.T) {
+	for _, dir := range []string{"multi", "local", "localtag"} {
+		files, _ := filepath.Glob(filepath.Join("testdata", dir, "*_ti.go"))
+		for _, f := range files {
+			assert.NoError(t, os.Remove(f))
+		}
+	}
+	err := RunPackages(Options{Verify: true}, "./testdata/multi", "./testdata/local", "./testdata/localtag")
+	assert.NoError(t, err)
+	for _, f := range []string{"multi/collections_ti.go", "multi/filters_ti.go", "multi/other_ti.go", "local/local_ti.go", "localtag/stack_gen_ti.go"} {
+		assert.True(t, pathExists(filepath.Join("testdata", f)), f)
+	}
+}
+
+func TestTypeParams(t *testing.T) {
+	err := RunOptions(Options{File: "testdata/typeparams/typeparams.go", Verify: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("testdata/typeparams/typeparams_ti.go")
+	assert.NoError(t, err)
+	src := string(b)
+	assert.Contains(t, src, "type StrMap[V any] map[string]V")
+	assert.Contains(t, src, "func (m StrMap[K]) Values() []K {") // receiver type param shadows typevar K
+	assert.Contains(t, src, "type IntAcc[N ~int | ~int64 | ~float64, E interface{ comparable }] struct {")
+	assert.Contains(t, src, "func NewIntAcc[N ~int | ~int64 | ~float64, E comparable](key int) *IntAcc[N, E] {")
+	assert.Contains(t, src, "type IntPtrs[P *int,] []P")
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, copyDir("testdata/migrate", dir))
+	dslFile := filepath.Join(dir, "use", "dsl.go")
+	assert.NoError(t, RunOptions(Options{File: dslFile, Verify: true}))
+	assert.True(t, pathExists(filepath.Join(dir, "use", "dsl_ti.go")))
+
+	assert.NoError(t, Migrate(Options{File: dslFile}))
+	assert.False(t, pathExists(filepath.Join(dir, "use", "dsl_ti.go")))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "set", "set.go"))
+	assert.NoError(t, err)
+	src := string(b)
+	assert.Contains(t, src, "// Set of E\ntype Set[E comparable] map[E]struct{}")
+	assert.Contains(t, src, "func NewList[E comparable]() *List[E] {\n\treturn &List[E]{set: NewSet[E]()}")
+	assert.Contains(t, src, "type Values[V any] []V")
+	assert.Contains(t, src, "func (Count[E]) Apply(s Set[E], vs ...E) (n int) {")
+	assert.NotContains(t, src, "type E = interface{}")
+	b, err = ioutil.ReadFile(dslFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "StrSet     = set.Set[string]")
+	assert.Contains(t, string(b), "countStr      = set.Count[string]{}.Apply")
+	assert.Contains(t, string(b), "hasStr        = set.Has[string]\n")
+	assert.NotContains(t, string(b), "go:build")
+
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("migrated code does not compile: %v\n%s", err, out)
+	}
+}
+
+func TestMigrateOtherModule(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, copyDir("testdata/migrate", filepath.Join(dir, "lib")))
+	assert.NoError(t, copyDir("testdata/migrate/use", filepath.Join(dir, "app")))
+	gomod := "module example.com/app\n\ngo 1.18\n\nrequire example.com/migrate v0.0.0\n\nreplace example.com/migrate => ../lib\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app", "go.mod"), []byte(gomod), 0644))
+	setFile := filepath.Join(dir, "lib", "set", "set.go")
+	before, err := ioutil.ReadFile(setFile)
+	assert.NoError(t, err)
+
+	err = Migrate(Options{File: filepath.Join(dir, "app", "dsl.go")})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "package example.com/migrate/set is outside the main module (it belongs to example.com/migrate)")
+	}
+	after, err := ioutil.ReadFile(setFile)
+	assert.NoError(t, err)
+	assert.Equal(t, string(before), string(after))
+}
+
+func TestMigrateTests(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, copyDir("testdata/migrate", dir))
+	setTest := filepath.Join(dir, "set", "set_test.go")
+	assert.NoError(t, ioutil.WriteFile(setTest, []byte("package set\n\nimport \"testing\"\n\nfunc TestSet(t *testing.T) {\n\tvar e E\n\tNewSet(e)\n}\n"), 0644))
+	// tests which do not refer to generic declarations are fine
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "set", "other_test.go"), []byte("package set_test\n\nimport \"testing\"\n\nfunc TestOther(t *testing.T) {}\n"), 0644))
+	setFile := filepath.Join(dir, "set", "set.go")
+	before, err := ioutil.ReadFile(setFile)
+	assert.NoError(t, err)
+
+	err = Migrate(Options{File: filepath.Join(dir, "use", "dsl.go")})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), setTest+":6:8: test file refers to generic E, tests of generic packages cannot be migrated")
+		assert.NotContains(t, err.Error(), "other_test.go")
+	}
+	after, err := ioutil.ReadFile(setFile)
+	assert.NoError(t, err)
+	assert.Equal(t, string(before), string(after))
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, b, 0644)
+	})
+}
+
+func TestIndexArgs(t *testing.T) {
+	err := RunOptions(Options{File: "testdata/indexargs/dsl.go", Verify: true})
+	assert.NoError(t, err)
+	cmd := exec.Command("go", "vet", "github.com/dlepex/typeinst/testdata/indexargs")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf(string(b))
+	}
+
+	impl := NewImpl("testdata/indexargs/dsl_ti.go", "indexargs")
+	impl.session = NewSession()
+	p, err := impl.Package(`"github.com/dlepex/typeinst/testdata/g/maps"`, Imports{})
+	assert.NoError(t, err)
+	args, err := p.bindTypeArgs("TreeMap", []string{"int", "string"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"K": "int", "V": "string"}, args)
+	_, err = p.bindTypeArgs("Map", []string{"int"})
+	assert.EqualError(t, err, "generic type Map has 2 typevars (K, V), but 1 type arguments are given")
+	args, err = p.bindTypeArgs("Keys", []string{"string", "int"}) // V is reached through generic func
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"K": "string", "V": "int"}, args)
+
+	dsls, err := ParseDSLs("testdata/indexargs/dsl.go", DefaultStructName)
+	assert.NoError(t, err)
+	impl = NewImpl("testdata/indexargs/dsl_ti.go", "indexargs")
+	assert.NoError(t, impl.AddDSL(dsls[0]))
+	for _, it := range dsls[0].Items {
+		assert.Empty(t, it.TypeArgs, "AddDSL modified args of %s", it.InstName)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, RunOptions(Options{File: "testdata/indexargs/dsl.go", Logger: log.New(buf, "", 0)}))
+	assert.Contains(t, buf.String(), "dsl: type StrIntMap = Map with args: map[K:string V:int]")
+	// the output is written by the first run (unless it is up to date already)
+	buf.Reset()
+	assert.NoError(t, RunOptions(Options{File: "testdata/indexargs/dsl.go", Logger: log.New(buf, "", 0)}))
+	assert.Contains(t, buf.String(), "unchanged: testdata/indexargs/dsl_ti.go")
+}
+
+func TestLibrary(t *testing.T) {
+	impl := NewImpl("testdata/indexargs/lib_ti.go", "indexargs")
+	assert.NoError(t, impl.Import("time", "time"))
+	assert.NoError(t, impl.Instantiate("github.com/dlepex/typeinst/testdata/g/maps", "Map", "Durations", map[string]string{"K": "string", "V": "time.Duration"}))
+	assert.Error(t, impl.Instantiate("github.com/dlepex/typeinst/testdata/g/maps", "NoSuchType", "X", nil))
+	assert.NoError(t, impl.Resolve())
+	b, err := impl.Bytes()
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "type Durations map[string]time.Duration")
+	assert.Contains(t, string(b), `time "time"`)
+	assert.NoError(t, impl.Verify(b, indexArgsOutput(t)))
+}
+
+// indexArgsOutput generates testdata/indexargs/dsl_ti.go in memory: use.go of package indexargs refers to its types,
+// so it is the sibling of other files verified in this package (see Verify), whether it is on disk or not.
+func indexArgsOutput(t *testing.T) map[string][]byte {
+	t.Helper()
+	dsl, err := ParseDSL("testdata/indexargs/dsl.go", DefaultStructName)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	impl := NewImpl("testdata/indexargs/dsl_ti.go", "indexargs")
+	assert.NoError(t, impl.AddDSL(dsl))
+	assert.NoError(t, impl.Resolve())
+	b, err := impl.Bytes()
+	assert.NoError(t, err)
+	return map[string][]byte{"testdata/indexargs/dsl_ti.go": b}
+}
+
+func TestGeneratedImports(t *testing.T) {
+	// fmt is imported by generic package maps, but only TreeMap (not instantiated) uses it
+	impl := NewImpl("testdata/indexargs/imports_ti.go", "indexargs")
+	assert.NoError(t, impl.Instantiate("github.com/dlepex/typeinst/testdata/g/maps", "Map", "StrToInt", map[string]string{"K": "string", "V": "int"}))
+	assert.NoError(t, impl.Resolve())
+	b, err := impl.Bytes()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), `"fmt"`)
+	assert.NoError(t, impl.Verify(b, indexArgsOutput(t)))
+}
+
+func TestSelectorOperand(t *testing.T) {
+	// operand of selector (e.g. ctor call) is renamed too
+	impl := NewImpl("testdata/indexargs/selector_ti.go", "indexargs")
+	assert.NoError(t, impl.Instantiate("github.com/dlepex/typeinst/testdata/g/list", "List", "StrList", map[string]string{"T": "string"}))
+	assert.NoError(t, impl.Resolve())
+	b, err := impl.Bytes()
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "return !newStrListIter(l).next()")
+	assert.NoError(t, impl.Verify(b, indexArgsOutput(t)))
+}
+
+func TestConcurrentImpls(t *testing.T) {
+	gen := func() ([]byte, error) {
+		impl := NewImpl("testdata/indexargs/lib_ti.go", "indexargs")
+		if err := impl.Instantiate("github.com/dlepex/typeinst/testdata/g/maps", "TreeMap", "IntMap", map[string]string{"K": "int", "V": "int"}); err != nil {
+			return nil, err
+		}
+		if err := impl.Resolve(); err != nil {
+			return nil, err
+		}
+		return impl.Bytes()
+	}
+	want, err := gen()
+	assert.NoError(t, err)
+	res := make([][]byte, 8)
+	assert.NoError(t, parallel(len(res), func(i int) (err error) {
+		res[i], err = gen()
+		return
+	}))
+	for _, b := range res {
+		assert.Equal(t, string(want), string(b))
+	}
+}
+
+// genAndVet generates the file of opts (with verification), vets its package and returns the generated source
+func genAndVet(t *testing.T, opts Options) string {
+	t.Helper()
+	opts.Verify = true
+	if !assert.NoError(t, RunOptions(opts)) {
+		return ""
+	}
+	b, err := ioutil.ReadFile(strings.TrimSuffix(opts.File, filepath.Ext(opts.File)) + FileSuffix + ".go")
+	assert.NoError(t, err)
+	cmd := exec.Command("go", "vet", "github.com/dlepex/typeinst/"+filepath.ToSlash(filepath.Dir(opts.File)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Error(string(out))
+	}
+	return string(b)
+}
+
+func TestManifest(t *testing.T) {
+	src := genAndVet(t, Options{File: "testdata/manifest/typeinst.json"})
+	assert.Contains(t, src, "type Durations map[string]time.Duration")
+	assert.Contains(t, src, "type Strs []string")
+	assert.EqualError(t, RunOptions(Options{File: "testdata/manifest/typeinst.yaml"}), "testdata/manifest/typeinst.yaml: YAML manifests are not supported, use JSON")
+}
+
+func TestFuncs(t *testing.T) {
+	src := genAndVet(t, Options{File: "testdata/funcs/dsl.go"})
+	assert.Contains(t, src, "func intMax(a, b int) int {")
+	assert.Contains(t, src, "func sumInts(a []int) int {")
+	// dependency of generic func is instantiated too
+	assert.Contains(t, src, "m = MaxFloatMax(m, v)")
+
+	impl := NewImpl("testdata/funcs/half_ti.go", "funcs")
+	assert.NoError(t, impl.Instantiate("github.com/dlepex/typeinst/testdata/g/num", "Half", "intHalf", map[string]string{"Number": "int"}))
+	err := impl.Resolve()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "num.go:35:6: func Half is not generic (it does not depend on typevars), it cannot be instantiated as intHalf")
+	}
+}
+
+func TestNonGeneric(t *testing.T) {
+	err := RunOptions(Options{File: "testdata/nongen/dsl.go", Verify: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "nongen.go:22:5: var pushes is not generic")
+		assert.Contains(t, err.Error(), "nongen.go:30:1: func describe is not generic")
+		assert.NotContains(t, err.Error(), "unused")
+	}
+	src := genAndVet(t, Options{File: "testdata/nongen/dsl.go", Copy: true})
+	assert.Contains(t, src, "var nongenPushes int")
+	assert.Contains(t, src, "func (c *nongenCounter) inc() {")
+	assert.Contains(t, src, "return nongenDescribe(len(s))")
+	assert.NotContains(t, src, "unused")
+	// the other output of the package refers to the same copies
+	b, err := ioutil.ReadFile("testdata/nongen/more_ti.go")
+	assert.NoError(t, err)
+	src = string(b)
+	assert.Contains(t, src, "nongenPushes++")
+	assert.Contains(t, src, "return nongenDescribe(len(s))")
+	assert.NotContains(t, src, "var nongenPushes int")
+	assert.NotContains(t, src, "func nongenDescribe(")
+}
+
+func TestNonGenericSeparateRuns(t *testing.T) {
+	for _, f := range []string{"a_ti.go", "strs_ti.go"} {
+		_ = os.Remove(filepath.Join("testdata/nongen2", f))
+	}
+	// b.go is generated after a.go by the other run: the code copied into a_ti.go is not copied again
+	a := genAndVet(t, Options{File: "testdata/nongen2/a.go", Copy: true})
+	assert.NoError(t, RunOptions(Options{File: "testdata/nongen2/b.go", Copy: true, Verify: true}))
+	bb, err := ioutil.ReadFile("testdata/nongen2/strs_ti.go")
+	assert.NoError(t, err)
+	b := string(bb)
+	assert.Contains(t, a, "func nongenDescribe(")
+	assert.Contains(t, b, "return nongenDescribe(len(s))")
+	assert.NotContains(t, b, "func nongenDescribe(")
+	assert.NotContains(t, b, "type nongenCounter")
+	// regeneration of a_ti.go keeps the copies
+	a = genAndVet(t, Options{File: "testdata/nongen2/a.go", Copy: true})
+	assert.Contains(t, a, "func nongenDescribe(")
+
+	err = RunOptions(Options{File: "testdata/nongenclash/dsl.go", Copy: true, Verify: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "nongenDescribe redeclared in this block [copied func describe, declaration: ")
+	}
+}
+
+func TestBodyDeps(t *testing.T) {
+	src := genAndVet(t, Options{File: "testdata/bodydeps/dsl.go"})
+	// stack and iter are used only in method bodies
+	assert.Contains(t, src, "var st intsStack")
+	assert.Contains(t, src, "type intsNode struct {")
+	assert.Contains(t, src, "for it := newIntsIter(l); it.next(); {")
+}
+
+func TestCrossPkg(t *testing.T) {
+	src := genAndVet(t, Options{File: "testdata/crosspkg/dsl.go"})
+	// set.Set of string is shared with dsl-struct instance
+	assert.Contains(t, src, "type StrGraph struct{ adj map[string]StrSet }")
+	assert.Contains(t, src, "s = NewStrSet()")
+	// set.Set of int is instantiated transitively
+	assert.Contains(t, src, "type IntGraphSet map[int]struct{}")
+	assert.Contains(t, src, "func (g *IntGraph) Adjacent(a int) IntGraphSet {")
+	assert.NotContains(t, src, "set.")
+	// graph.Graph of string is shared by StrWeighted
+	assert.Contains(t, src, "return &StrWeighted{NewStrGraph(), make(map[[2]string]float64)}")
+	assert.NotContains(t, src, "StrWeightedGraph")
+}
+
+func TestImportCycle(t *testing.T) {
+	impl := NewImpl("testdata/crosspkg/cycle_ti.go", "crosspkg")
+	assert.NoError(t, impl.Instantiate("github.com/dlepex/typeinst/testdata/g/cycle/a", "List", "Ints", map[string]string{"T": "int"}))
+	err := impl.Resolve()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "generic package \"github.com/dlepex/typeinst/testdata/g/cycle/a\" is not resolved")
+		assert.Contains(t, err.Error(), "generic package \"github.com/dlepex/typeinst/testdata/g/cycle/b\" is not resolved")
+	}
+}
+
+func TestSessionModules(t *testing.T) {
+	root, _ := filepath.Abs(".")
+	assert.Equal(t, root, moduleRoot("testdata/usage"))
+	assert.Equal(t, filepath.Join(root, "testdata/migrate"), moduleRoot("testdata/migrate/use"))
+	s := NewSession()
+	d, err := s.packageDir("testdata/usage", "github.com/dlepex/typeinst/testdata/g/set")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "testdata/g/set"), d)
+	// package dir is cached per module: the module of testdata/migrate does not have this package
+	_, err = s.packageDir("testdata/migrate/use", "github.com/dlepex/typeinst/testdata/g/set")
+	assert.Error(t, err)
 }
@@ -0,0 +1,324 @@
+package typeinst
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dlepex/typeinst/internal/sets"
+)
+
+// Verify type-checks generated src together with the rest of the target package (the package of output file).
+// Errors found in generated code are mapped back to generic declarations and dsl-struct fields which produced it.
+// Other files generated for the target package by the same run (file -> src) are used instead of their on-disk copies,
+// which may be missing or stale, errors in them are left to their own verification.
+func (im *Impl) Verify(src []byte, siblings map[string][]byte) error {
+	return im.verify(src, nil, siblings)
+}
+
+// VerifyTests is Verify which also type-checks generated test file testSrc (see TestBytes),
+// together with the tests of the target package, generated test files of the same run are taken from siblings.
+func (im *Impl) VerifyTests(src, testSrc []byte, siblings map[string][]byte) error {
+	return im.verify(src, testSrc, siblings)
+}
+
+// verify implements Verify and VerifyTests (if testSrc is not nil)
+func (im *Impl) verify(src, testSrc []byte, siblings map[string][]byte) error {
+	dir := filepath.Dir(im.outputFile)
+	tests := testSrc != nil
+	fset := token.NewFileSet()
+	names := make([]string, 0, len(siblings))
+	for fn := range siblings {
+		names = append(names, fn)
+	}
+	sort.Strings(names)
+	exclude := sets.NewStrSet()
+	for _, fn := range append(names, im.outputFile, im.TestOutputFile()) {
+		abs, _ := filepath.Abs(fn)
+		exclude.Add(abs)
+	}
+	files, err := parseTargetPkg(fset, dir, exclude, im.pkgName, tests)
+	if err != nil {
+		return err
+	}
+	sibFiles := make(map[*token.File]bool)
+	for _, fn := range names {
+		if fn == im.outputFile || fn == im.TestOutputFile() || !tests && strings.HasSuffix(fn, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, fn, siblings[fn], 0)
+		if err != nil {
+			return err
+		}
+		if f.Name.Name == im.pkgName {
+			files = append(files, f)
+			sibFiles[fset.File(f.Pos())] = true
+		}
+	}
+	gen, err := parser.ParseFile(fset, im.outputFile, src, 0)
+	if err != nil {
+		return err
+	}
+	files = append(files, gen)
+	if tests {
+		genTest, err := parser.ParseFile(fset, im.TestOutputFile(), testSrc, 0)
+		if err != nil {
+			return err
+		}
+		files = append(files, genTest)
+	}
+	imp, err := newExportImporter(fset, dir, files)
+	if err != nil {
+		return err
+	}
+	var errs ErrorList
+	conf := types.Config{
+		Importer: imp,
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok && sibFiles[fset.File(terr.Pos)] {
+				return
+			}
+			errs.Add(im.mapTypeError(fset, gen, err))
+		},
+	}
+	pkg, _ := conf.Check(im.pkgName, fset, files, nil)
+	constraintErrs := im.checkConstraints(fset, pkg, gen.Name.End(), true)
+	return append(constraintErrs, errs...).Err()
+}
+
+// checkTypeArgs checks type args against typevar constraints before anything is generated: the target package
+// is type-checked without generated files (its errors are ignored), type args are evaluated in the scope of imports of impl.
+// Type args which cannot be evaluated without generated code (e.g. instances of other generic types) are left to Verify.
+func (im *Impl) checkTypeArgs() error {
+	if !im.hasConstraints() {
+		return nil
+	}
+	dir := filepath.Dir(im.outputFile)
+	fset := token.NewFileSet()
+	exclude := sets.NewStrSet()
+	abs, _ := filepath.Abs(im.outputFile)
+	exclude.Add(abs)
+	files, err := parseTargetPkg(fset, dir, exclude, im.pkgName, false)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	src := &bytes.Buffer{}
+	fmt.Fprintf(src, "package %s\n\n", im.pkgName)
+	if !im.imports.IsEmpty() {
+		newAstPrinter(src, nil).println(im.imports.decl())
+	}
+	scope, err := parser.ParseFile(fset, im.outputFile, src.Bytes(), 0)
+	if err != nil {
+		return err
+	}
+	files = append(files, scope)
+	imp, err := newExportImporter(fset, dir, files)
+	if err != nil {
+		return err
+	}
+	conf := types.Config{Importer: imp, Error: func(error) {}}
+	pkg, _ := conf.Check(im.pkgName, fset, files, nil)
+	return im.checkConstraints(fset, pkg, scope.Name.End(), false).Err()
+}
+
+func (im *Impl) hasConstraints() bool {
+	for _, pd := range im.pkg {
+		for tv := range pd.typevars {
+			if pd.types[tv].constraint() != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkConstraints checks that type args satisfy non-empty interface typevars (with typevar substituted by type arg),
+// type args are evaluated at pos, if strict is false the ones which cannot be evaluated are skipped.
+// Type args and interfaces are evaluated in the scope of generated file.
+func (im *Impl) checkConstraints(fset *token.FileSet, pkg *types.Package, pos token.Pos, strict bool) ErrorList {
+	var errs ErrorList
+	for _, path := range im.pkgOrder {
+		pd := im.pkg[path]
+		for _, tv := range sortedStrs(pd.typevars) {
+			ct := pd.types[tv].constraint()
+			if ct == nil {
+				continue
+			}
+			checked := make(map[*TypeArgs]bool)
+			for _, t := range pd.sortedTypes() {
+				for _, args := range t.instOrder {
+					arg, has := args.Binds[tv]
+					if !has || checked[args] || !pd.generic.Contains(t.name()) {
+						continue
+					}
+					checked[args] = true
+					dslPos, _ := im.instDslPos(printOrigin{pd, t.spec.Pos(), args, t.inst[args], ""})
+					argType, err := types.Eval(fset, pkg, pos, arg)
+					if err != nil && !strict {
+						continue
+					}
+					if err != nil {
+						errs.Add(errorfAt(dslPos, "cannot evaluate type %s (substitution of typevar %s): %v", arg, tv, err))
+						continue
+					}
+					src := &bytes.Buffer{}
+					pd.newPrinter(src, pd.renameFunc(args), args).println(ct)
+					ifaceType, err := types.Eval(fset, pkg, pos, src.String())
+					if err != nil {
+						logf(im.log, "cannot check typevar %s constraint: %v", tv, err)
+						continue
+					}
+					iface, ok := ifaceType.Type.Underlying().(*types.Interface)
+					if !ok {
+						continue
+					}
+					if err := implements(argType.Type, iface); err != nil {
+						errs.Add(errorfAt(dslPos, "type %s does not implement %s: %v (typevar declared at %s)",
+							arg, tv, err, pd.position(pd.types[tv].spec)))
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// implements is types.Implements with explanation. Only the method set of t itself is considered:
+// generated code may call methods on values which are not addressable (map elements, results of calls etc.)
+func implements(t types.Type, iface *types.Interface) error {
+	m, wrongType := types.MissingMethod(t, iface, true)
+	if m == nil {
+		return nil
+	}
+	if _, isPtr := t.(*types.Pointer); !isPtr {
+		if pm, _ := types.MissingMethod(types.NewPointer(t), iface, true); pm == nil {
+			return fmt.Errorf("method %s has pointer receiver", m.Name())
+		}
+	}
+	if wrongType {
+		return fmt.Errorf("wrong type for method %s", m.Name())
+	}
+	return fmt.Errorf("missing method %s", m.Name())
+}
+
+// parseTargetPkg parses files of package pkgName in dir (excluding generated files and files not matching build tags),
+// _test.go files are included only if tests is true, exclude contains absolute names of generated files
+func parseTargetPkg(fset *token.FileSet, dir string, exclude sets.StrSet, pkgName string, tests bool) ([]*ast.File, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []*ast.File
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !pkgFileFilter(info) && !(tests && strings.HasSuffix(name, "_test.go")) {
+			continue
+		}
+		fn := filepath.Join(dir, name)
+		if abs, _ := filepath.Abs(fn); exclude.Contains(abs) {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, fn, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if f.Name.Name != pkgName {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// newExportImporter returns importer which reads export data of files imports (and their deps) produced by `go list -export`
+func newExportImporter(fset *token.FileSet, dir string, files []*ast.File) (types.Importer, error) {
+	paths := sets.NewStrSet()
+	for _, f := range files {
+		for _, spec := range f.Imports {
+			if p := unquote(spec.Path.Value); p != "unsafe" && p != "C" {
+				paths.Add(p)
+			}
+		}
+	}
+	exports := make(map[string]string)
+	if len(paths) != 0 {
+		pkgs, err := goList(dir, []string{"-export", "-deps"}, sortedStrs(paths)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pkgs {
+			if p.Error != nil && paths.Contains(p.ImportPath) {
+				return nil, fmt.Errorf("cannot load package %s: %s", p.ImportPath, p.Error.Err)
+			}
+			exports[p.ImportPath] = p.Export
+		}
+	}
+	lookup := func(path string) (io.ReadCloser, error) {
+		f, ok := exports[path]
+		if !ok || f == "" {
+			return nil, fmt.Errorf("no export data for package %s", path)
+		}
+		return os.Open(f)
+	}
+	return importer.ForCompiler(fset, "gc", lookup), nil
+}
+
+// mapTypeError adds the origin (generic declaration and dsl-struct field) to the type error found in generated file
+func (im *Impl) mapTypeError(fset *token.FileSet, gen *ast.File, err error) error {
+	terr, ok := err.(types.Error)
+	if !ok || fset.File(terr.Pos) != fset.File(gen.Pos()) {
+		return err
+	}
+	var decls []ast.Decl
+	for _, d := range gen.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			continue
+		}
+		decls = append(decls, d)
+	}
+	if len(decls) != len(im.origins) {
+		return errorfAt(fset.Position(terr.Pos), "%s", terr.Msg)
+	}
+	i := sort.Search(len(decls), func(i int) bool { return decls[i].End() >= terr.Pos })
+	if i == len(decls) || decls[i].Pos() > terr.Pos {
+		return errorfAt(fset.Position(terr.Pos), "%s", terr.Msg)
+	}
+	o := im.origins[i]
+	if o.copied != "" {
+		return errorfAt(fset.Position(terr.Pos), "%s [copied %s, declaration: %s]", terr.Msg, o.copied, o.pkg.fset.Position(o.pos))
+	}
+	from := []string{fmt.Sprintf("generic declaration: %s", o.pkg.fset.Position(o.pos))}
+	if pos, ok := im.instDslPos(o); ok {
+		from = append(from, fmt.Sprintf("dsl-struct field: %s", pos))
+	}
+	return errorfAt(fset.Position(terr.Pos), "%s [type %s, %s]", terr.Msg, o.instName, strings.Join(from, ", "))
+}
+
+// instDslPos finds dsl-struct field of the instance, non-root instances are mapped to some root with the same type args
+func (im *Impl) instDslPos(o printOrigin) (token.Position, bool) {
+	if pos, ok := im.dslPos[o.instName]; ok {
+		return pos, true
+	}
+	for _, t := range o.pkg.sortedTypes() {
+		if n, ok := t.inst[o.args]; ok {
+			if pos, ok := im.dslPos[n]; ok {
+				return pos, true
+			}
+		}
+	}
+	return token.Position{}, false
+}
@@ -1,40 +1,70 @@
-package main
+package typeinst
 
 import (
 	"fmt"
 	"go/ast"
-	"go/parser"
+	"go/build/constraint"
 	"go/token"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/dlepex/typeinst/internal/sets"
 )
 
 type (
 	// Impl - root structure, it aggregates all generic packages - it will be printed as a single implementation file
 	Impl struct {
 		pkg        map[string]*PkgDesc
+		pkgOrder   []string // package paths in order of their first use, it keeps output deterministic
 		imports    Imports
-		pkgName    string // generated package name
-		outputFile string // generated file name
+		pkgName    string                    // generated package name
+		outputFile string                    // generated file name
+		origins    []printOrigin             // origins of printed top-level declarations, in print order
+		dslPos     map[string]token.Position // instance name -> dsl-struct field position
+		session    *Session                  // shared with other Impls of the same run
+		withTests  bool                      // instantiate tests of generic packages too
+		localDir   string                    // dir of dsl-struct package, it contains local generic types (templates)
+		targs      typeArgsCache             // shared by all packages of impl
+		copyNonGen bool                      // copy non-generic code used by generic code, see SetCopyNonGeneric()
+		log        *log.Logger               // nil means silent, see SetLogger()
 	}
 
 	// PkgDesc contains generic package desc - all types and their functions
 	PkgDesc struct {
-		name      string
-		types     map[string]*TypeDesc     // all package types by name
-		ctors     map[string]*TypeDesc     // ctor name -> type (it belongs)
-		typevars  StrSet                   // set of type variables
-		generic   StrSet                   // set of generic types
-		funcs     map[string]*ast.FuncDecl // free standing funcs (i.e. no recever), excluding type ctors
-		impRename map[string]string        // what imports should be renamed within pkg AST: name -> newname
-		isStrict  bool                     // strict mode means all typevars of the pkg are markerd with special comment "//typeinst: typevar"
-		consts    map[string]ast.Expr      // const -> value
-		occTypes  AstIdentSet              // occurences of types identifiers in AST (that may be renamed)
-		occPkgs   AstIdentSet              // ... of packages identifiers ...
-		occCtors  AstIdentSet              // ... of constructor functions ...
-		occConsts AstIdentSet              // ... of constants ...
+		name         string
+		fset         *token.FileSet                   // positions of the parsed package files
+		types        map[string]*TypeDesc             // all package types by name
+		ctors        map[string]*TypeDesc             // ctor name -> type (it belongs)
+		typevars     sets.StrSet                      // set of type variables
+		generic      sets.StrSet                      // set of generic types
+		funcs        map[string]*ast.FuncDecl         // free standing funcs (i.e. no recever), excluding type ctors
+		impRename    map[string]string                // what imports should be renamed within pkg AST: name -> newname
+		isStrict     bool                             // strict mode means all typevars of the pkg are markerd with special comment "//typeinst: typevar"
+		consts       map[string]ast.Expr              // const -> value
+		vars         map[string]*ast.ValueSpec        // package level var -> its spec
+		pkgName      string                           // name in package clause
+		occTypes     sets.AstIdentSet                 // occurences of types identifiers in AST (that may be renamed)
+		occPkgs      sets.AstIdentSet                 // ... of packages identifiers ...
+		occCtors     sets.AstIdentSet                 // ... of constructor functions ...
+		occConsts    sets.AstIdentSet                 // ... of constants ...
+		testFuncs    []*ast.FuncDecl                  // funcs of _test.go files (only if tests are instantiated)
+		testOwner    map[string]*TypeDesc             // test func name -> generic type it is instantiated for
+		testTypevars map[string]sets.StrSet           // test func name -> typevars of func which depends only on them
+		occTests     sets.AstIdentSet                 // ... of test funcs
+		targs        typeArgsCache                    // cache of impl, see Inst()
+		nonGen       *nonGenericCode                  // non-generic code used by generic code, see resolveNonGeneric()
+		copyNonGen   bool                             // copy non-generic code into generated file instead of reporting it
+		imports      Imports                          // imports of package files, by original names
+		tvAliases    map[string]*ast.SelectorExpr     // aliases of members of imported packages e.g. type V = set.E, see genericImports()
+		deps         map[string]*PkgDesc              // import name -> imported generic package, see Impl.Resolve()
+		occForeign   map[*ast.Ident]*ast.SelectorExpr // occurences of generic members of imported generic packages (qualifiers and members)
+		foreignInst  map[foreignKey]string            // instances of generic types of imported generic packages, see instForeign()
+		log          *log.Logger                      // logger of impl
 	}
 
 	// TypeDesc provides full type info
@@ -43,19 +73,158 @@ type (
 		methods     []*ast.FuncDecl
 		ctors       []*ast.FuncDecl      // constructor functions
 		inst        map[*TypeArgs]string // typeargs -> instname; (map nonempty only for generic types)
-		typevars    StrSet               // set is populated by typevars upon which this generic type depends
+		instOrder   []*TypeArgs          // keys of inst in order of instantiation (i.e. dsl-struct order)
+		typevars    sets.StrSet          // set is populated by typevars upon which this generic type depends
 		isTypevar   bool                 // does this type serves as a typevar?
 		isVisited   bool                 // was this type ever visited from any "root" generic type
 		isSingleton bool                 // was type declared as empty struct (ESGT)?
+		isFunc      bool                 // is it a free standing func (its only "method"), see PkgDesc.funcUnit()
+		foreign     []*ast.SelectorExpr  // generic members of imported generic packages it depends on
 	}
 )
 
-func newImpl(outputFile, pkgName string) *Impl {
+// NewImpl creates an empty implementation file of package pkgName, generic packages are resolved relative to the dir of outputFile.
+// Instances are added by AddDSL() or Instantiate(), then Resolve() must be called before printing.
+func NewImpl(outputFile, pkgName string) *Impl {
 	return &Impl{
 		pkg:        make(map[string]*PkgDesc),
 		outputFile: outputFile,
 		pkgName:    pkgName,
+		dslPos:     make(map[string]token.Position),
+		session:    NewSession(),
+		localDir:   filepath.Dir(outputFile),
+		targs:      make(typeArgsCache),
+	}
+}
+
+// SetSession makes impl share parsed generic packages with other Impls of the session s
+func (impl *Impl) SetSession(s *Session) {
+	impl.session = s
+}
+
+// SetLogger sets the logger of progress messages and warnings, by default impl is silent
+func (impl *Impl) SetLogger(l *log.Logger) {
+	impl.log = l
+}
+
+// SetCopyNonGeneric sets whether non-generic code (funcs, vars and types) used by generic code is copied into generated file
+// under mangled names, by default such code is reported as an error. It must be set before instances are added.
+func (impl *Impl) SetCopyNonGeneric(on bool) {
+	impl.copyNonGen = on
+}
+
+// OutputFile returns the name of generated file
+func (impl *Impl) OutputFile() string {
+	return impl.outputFile
+}
+
+// Import adds import (path is unquoted) which may be referred by type arguments of Instantiate()
+func (impl *Impl) Import(name, path string) error {
+	return impl.imports.Add(name, strconv.Quote(path))
+}
+
+// AddDSL instantiates all items of dsl, errors are collected into ErrorList
+func (impl *Impl) AddDSL(dsl *DSL) error {
+	var errs ErrorList
+	impl.localDir = filepath.Dir(dsl.Filename)
+	// errors are reported by Package() for each dsl item
+	_ = impl.resolvePackages(dsl.genericPackages()...)
+	for _, it := range dsl.Items {
+		impl.dslPos[it.InstName] = it.Pos
+		itemArgs := copyTypeArgs(it.TypeArgs) // args bound by position are added to the copy, dsl is not modified
+		for _, g := range it.GenericTypes {
+			p, err := impl.Package(g.PkgName, dsl.Imports)
+			if err != nil {
+				errs.AddAt(it.Pos, err)
+				continue
+			}
+			typeArgs := itemArgs
+			if len(g.Args) != 0 {
+				if typeArgs, err = p.bindTypeArgs(g.Type, g.Args); err != nil {
+					errs.AddAt(it.Pos, err)
+					continue
+				}
+				for tv, a := range typeArgs {
+					itemArgs[tv] = a
+				}
+			}
+			logf(impl.log, "dsl: type %s = %s with args: %v", it.InstName, g.Type, typeArgs)
+			errs.AddAt(it.Pos, p.Inst(g.Type, it.InstName, typeArgs))
+		}
+	}
+	return errs.Err()
+}
+
+// Instantiate adds instance instName of generic type typName, pkgPath is the (unquoted) import path of generic package
+// or "" for local generic types. Type arguments must be Go type expressions, packages they refer to must be added by Import().
+func (impl *Impl) Instantiate(pkgPath, typName, instName string, typeArgs map[string]string) error {
+	if pkgPath != localPkgPath {
+		pkgPath = strconv.Quote(pkgPath)
+	}
+	p, err := impl.Package(pkgPath, Imports{})
+	if err != nil {
+		return err
+	}
+	return p.Inst(typName, instName, typeArgs)
+}
+
+// Resolve finds all dependencies of instantiated types, it must be called once after all instances are added.
+// Generic packages imported by generic packages are resolved after their importers, which instantiate them.
+// Type args are checked against typevar constraints (see checkTypeArgs).
+func (impl *Impl) Resolve() error {
+	var errs ErrorList
+	importers := make(map[*PkgDesc]int) // generic package -> number of its unresolved importers
+	for i := 0; i < len(impl.pkgOrder); i++ {
+		// imported generic packages are appended to pkgOrder
+		errs.Add(impl.linkGenericImports(impl.pkg[impl.pkgOrder[i]], importers))
+	}
+	resolved := make(map[*PkgDesc]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, path := range impl.pkgOrder {
+			pd := impl.pkg[path]
+			if resolved[pd] || importers[pd] != 0 {
+				continue
+			}
+			logf(impl.log, "walk: %s", path)
+			errs.Add(pd.resolveGeneric())
+			resolved[pd] = true
+			progress = true
+			for _, dep := range pd.deps {
+				importers[dep]--
+			}
+		}
+	}
+	for _, path := range impl.pkgOrder {
+		if pd := impl.pkg[path]; !resolved[pd] {
+			errs.Addf("generic package %s is not resolved: typevar aliases of generic packages form an import cycle", path)
+		}
+	}
+	if len(errs) == 0 {
+		errs.Add(impl.checkTypeArgs())
+	}
+	return errs.Err()
+}
+
+// linkGenericImports finds generic packages imported by pd (see genericImports) and adds them to impl
+func (impl *Impl) linkGenericImports(pd *PkgDesc, importers map[*PkgDesc]int) error {
+	var errs ErrorList
+	for _, q := range pd.genericImports() {
+		pos := pd.position(pd.tvAliases[pd.aliasesOf(q)[0]])
+		p := pd.imports.Named(q)
+		if p == "" {
+			errs.Add(errorfAt(pos, "package %s is not imported by package %s", q, pd.name))
+			continue
+		}
+		dep, err := impl.Package(p, Imports{})
+		if err != nil {
+			errs.AddAt(pos, err)
+			continue
+		}
+		pd.deps[q] = dep
+		importers[dep]++
 	}
+	return errs.Err()
 }
 
 func (td *TypeDesc) String() string {
@@ -66,16 +235,16 @@ func (td *TypeDesc) name() string {
 	return td.spec.Name.Name
 }
 
-func (td *TypeDesc) addFunc(f *ast.FuncDecl) {
+func (td *TypeDesc) addFunc(fset *token.FileSet, f *ast.FuncDecl) {
 	if td.isTypevar {
-		bpan.Panicf("Typevar %s can't be func receiver: %s", td.name(), f.Name.Name)
+		bpan.Check(errorfAt(fset.Position(f.Pos()), "Typevar %s can't be func receiver: %s", td.name(), f.Name.Name))
 	}
 	td.methods = append(td.methods, f)
 }
 
-func (td *TypeDesc) addCtor(f *ast.FuncDecl) {
+func (td *TypeDesc) addCtor(fset *token.FileSet, f *ast.FuncDecl) {
 	if td.isTypevar {
-		bpan.Panicf("Typevar %s can't have constructors: %s", td.name(), f.Name.Name)
+		bpan.Check(errorfAt(fset.Position(f.Pos()), "Typevar %s can't have constructors: %s", td.name(), f.Name.Name))
 	}
 	td.ctors = append(td.ctors, f)
 }
@@ -86,14 +255,21 @@ func (td *TypeDesc) initBinds() {
 	}
 }
 
+func (td *TypeDesc) addInst(b *TypeArgs, instName string) {
+	td.initBinds()
+	td.inst[b] = instName
+	td.instOrder = append(td.instOrder, b)
+}
+
 func (td *TypeDesc) canBeTypevar() bool {
 	return len(td.ctors) == 0 && len(td.methods) == 0
 }
 
 func (td *TypeDesc) isGeneric() bool { return len(td.typevars) != 0 }
 
+// isSingleFunc reports whether td is printed as a single func: ESGT with Apply method, or generic free standing func
 func (td *TypeDesc) isSingleFunc() bool {
-	return td.isSingleton && len(td.methods) == 1 && td.methods[0].Name.Name == "Apply"
+	return td.isFunc || td.isSingleton && len(td.methods) == 1 && td.methods[0].Name.Name == "Apply"
 }
 
 func isSingleton(spec *ast.TypeSpec) bool {
@@ -106,17 +282,40 @@ func isSingleton(spec *ast.TypeSpec) bool {
 	return false
 }
 
-// non-root type "inherits" bindings from parent
+// non-root type "inherits" bindings from parent, the existing instance (e.g. of dsl-struct) with the same bindings
+// of td typevars is reused, so it is not printed again under the mangled name
 func (td *TypeDesc) inheritFrom(parent *TypeDesc) {
 	if td == parent {
 		return
 	}
-	td.initBinds()
-	for b, instName := range parent.inst {
-		if _, has := td.inst[b]; !has {
-			td.inst[b] = MangleDepTypeName(td.name(), parent.name(), instName)
+	for _, b := range parent.instOrder {
+		if _, has := td.inst[b]; has {
+			continue
+		}
+		if instName, ok := td.instBoundAs(td.typevars, b); ok {
+			td.inst[b] = instName
+			continue
+		}
+		td.addInst(b, MangleDepTypeName(td.name(), parent.name(), parent.inst[b]))
+	}
+}
+
+// instBoundAs returns the instance whose args bind typevars tvs the same way as b does
+func (td *TypeDesc) instBoundAs(tvs sets.StrSet, b *TypeArgs) (string, bool) {
+	for _, ib := range td.instOrder {
+		same := true
+		for tv := range tvs {
+			a, ok := b.Binds[tv]
+			if ia, iok := ib.Binds[tv]; !ok || !iok || a != ia {
+				same = false
+				break
+			}
+		}
+		if same {
+			return td.inst[ib], true
 		}
 	}
+	return "", false
 }
 
 type tdescDict map[string]*TypeDesc
@@ -130,7 +329,7 @@ func (m tdescDict) get(name string) *TypeDesc {
 	return t
 }
 
-// Package - retrieves or parses generic package
+// Package - retrieves or parses generic package, pkgPath is the quoted import path (as in import spec) or "" for local generic types
 func (impl *Impl) Package(pkgPath string, imports Imports) (pkg *PkgDesc, err error) {
 	if p, ok := impl.pkg[pkgPath]; ok {
 		return p, nil
@@ -138,30 +337,50 @@ func (impl *Impl) Package(pkgPath string, imports Imports) (pkg *PkgDesc, err er
 	defer bpan.RecoverTo(&err)
 	types := tdescDict(make(map[string]*TypeDesc))
 	funcs := make(map[string]*ast.FuncDecl)
-	tpvars := NewStrSet()
-	fset := token.NewFileSet()
+	tpvars := sets.NewStrSet()
 	consts := make(map[string]ast.Expr)
-	pkgpath := packagePath(unquote(pkgPath))
-	if pkgpath == "" {
-		return nil, fmt.Errorf("no such package: %s", pkgPath)
+	vars := make(map[string]*ast.ValueSpec)
+	tvAliases := make(map[string]*ast.SelectorExpr)
+	name := pkgPath
+	pkgpath := impl.localDir
+	if pkgPath == localPkgPath {
+		name = localPkgName
+	} else if pkgpath, err = impl.session.packageDir(filepath.Dir(impl.outputFile), unquote(pkgPath)); err != nil {
+		return nil, err
 	}
-	m, err := parser.ParseDir(fset, pkgpath, pkgFileFilter, parser.ParseComments)
+	fset, m, err := impl.session.parseDir(pkgpath)
 	if err != nil {
 		return nil, err
 	}
-	for _, pkg := range m {
-		for fn, f := range pkg.Files {
+	var testFuncs []*ast.FuncDecl
+	var clauseName string
+	for pkgName, pkg := range m {
+		if strings.HasSuffix(pkgName, "_test") {
+			continue
+		}
+		clauseName = pkgName
+		for _, fn := range sortedFiles(pkg.Files) {
+			f := pkg.Files[fn]
+			if strings.HasSuffix(fn, "_test.go") {
+				if impl.withTests && pkgPath != localPkgPath {
+					testFuncs = append(testFuncs, parseTestFile(f, &imports)...)
+				}
+				continue
+			}
+			if pkgPath == localPkgPath && !isTemplateFile(f) {
+				continue
+			}
 			for _, spec := range f.Imports {
 				if err := imports.AddSpec(spec); err != nil {
-					return nil, fmt.Errorf("bad imports(...) in package: %s, file: %s, %v", pkgpath, fn, err)
+					return nil, errorfAt(fset.Position(spec.Pos()), "bad imports(...) in package: %s, %v", pkgpath, err)
 				}
 			}
 			for _, decl := range f.Decls {
 				switch decl := decl.(type) {
 				case *ast.FuncDecl:
-					if r := receiverType(decl); r != "" {
+					if r := receiverType(decl, impl.log); r != "" {
 						tdef := types.get(r)
-						tdef.addFunc(decl)
+						tdef.addFunc(fset, decl)
 					} else {
 						funcs[decl.Name.Name] = decl
 					}
@@ -174,9 +393,14 @@ func (impl *Impl) Package(pkgPath string, imports Imports) (pkg *PkgDesc, err er
 							tdef := types.get(name)
 							tdef.spec = tsp
 							tdef.isSingleton = isSingleton(tsp)
+							if sel, ok := tsp.Type.(*ast.SelectorExpr); ok && tsp.Assign.IsValid() {
+								if _, ok := sel.X.(*ast.Ident); ok {
+									tvAliases[name] = sel
+								}
+							}
 							if tsp.Comment != nil {
 								for _, c := range tsp.Comment.List {
-									if tdef.parseSpecialComment(c.Text) {
+									if tdef.parseSpecialComment(c.Text, impl.log) {
 										if tdef.isTypevar {
 											tpvars[name] = struct{}{}
 										}
@@ -184,6 +408,13 @@ func (impl *Impl) Package(pkgPath string, imports Imports) (pkg *PkgDesc, err er
 								}
 							}
 						}
+					case token.VAR:
+						for _, spec := range decl.Specs {
+							spec := spec.(*ast.ValueSpec)
+							for _, id := range spec.Names {
+								vars[id.Name] = spec
+							}
+						}
 					case token.CONST:
 						for _, spec := range decl.Specs {
 							spec := spec.(*ast.ValueSpec)
@@ -217,13 +448,113 @@ func (impl *Impl) Package(pkgPath string, imports Imports) (pkg *PkgDesc, err er
 		impRename = impl.imports.Merge(imports)
 	}
 
-	pkg = &PkgDesc{pkgPath, types, make(map[string]*TypeDesc), tpvars, NewStrSet(), funcs, impRename, len(tpvars) > 0, consts,
-		NewAstIdentSet(), NewAstIdentSet(), NewAstIdentSet(), NewAstIdentSet()}
+	sort.Slice(testFuncs, func(i, j int) bool { return testFuncs[i].Pos() < testFuncs[j].Pos() })
+	pkg = &PkgDesc{
+		name:        name,
+		pkgName:     clauseName,
+		fset:        fset,
+		types:       types,
+		ctors:       make(map[string]*TypeDesc),
+		typevars:    tpvars,
+		generic:     sets.NewStrSet(),
+		funcs:       funcs,
+		impRename:   impRename,
+		isStrict:    len(tpvars) > 0,
+		consts:      consts,
+		vars:        vars,
+		occTypes:    sets.NewAstIdentSet(),
+		occPkgs:     sets.NewAstIdentSet(),
+		occCtors:    sets.NewAstIdentSet(),
+		occConsts:   sets.NewAstIdentSet(),
+		testFuncs:   testFuncs,
+		occTests:    sets.NewAstIdentSet(),
+		targs:       impl.targs,
+		copyNonGen:  impl.copyNonGen,
+		imports:     imports,
+		tvAliases:   tvAliases,
+		deps:        make(map[string]*PkgDesc),
+		occForeign:  make(map[*ast.Ident]*ast.SelectorExpr),
+		foreignInst: make(map[foreignKey]string),
+		log:         impl.log,
+	}
 	pkg.detectCtors()
 	impl.pkg[pkgPath] = pkg
+	impl.pkgOrder = append(impl.pkgOrder, pkgPath)
 	return
 }
 
+func (impl *Impl) resolvePackages(paths ...string) error {
+	return impl.session.resolvePackages(filepath.Dir(impl.outputFile), paths...)
+}
+
+// localPkgPath is the package path of local generic types i.e. templates declared in the package of dsl-struct
+const localPkgPath = ""
+
+// localPkgName is PkgDesc.name of local generic types
+const localPkgName = "(local templates)"
+
+const templateTag = "typeinst"
+
+// isTemplateFile reports whether f contains local generic types: f must be marked by "//typeinst:template" comment
+// or by build constraint which requires "typeinst" tag (which excludes it from the compiled package).
+func isTemplateFile(f *ast.File) bool {
+	var expr constraint.Expr
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			text := c.Text
+			if strings.HasPrefix(text, commentPrefix) && strings.TrimSpace(strings.TrimPrefix(text, commentPrefix)) == "template" {
+				return true
+			}
+			if c.Pos() > f.Package || !constraint.IsGoBuild(text) && (expr != nil || !constraint.IsPlusBuild(text)) {
+				continue
+			}
+			// //go:build line takes precedence over // +build lines
+			if x, err := constraint.Parse(text); err == nil {
+				expr = x
+			}
+		}
+	}
+	return expr != nil && requiresTag(expr, templateTag)
+}
+
+// requiresTag reports whether build constraint x is satisfied only if tag is set,
+// i.e. it is unsatisfiable without tag (for any combination of the other tags)
+func requiresTag(x constraint.Expr, tag string) bool {
+	others := sets.NewStrSet()
+	var collect func(x constraint.Expr)
+	collect = func(x constraint.Expr) {
+		switch x := x.(type) {
+		case *constraint.TagExpr:
+			if x.Tag != tag {
+				others.Add(x.Tag)
+			}
+		case *constraint.NotExpr:
+			collect(x.X)
+		case *constraint.AndExpr:
+			collect(x.X)
+			collect(x.Y)
+		case *constraint.OrExpr:
+			collect(x.X)
+			collect(x.Y)
+		}
+	}
+	collect(x)
+	tags := sortedStrs(others)
+	if len(tags) > 16 {
+		return false
+	}
+	for set := 0; set < 1<<len(tags); set++ {
+		ok := func(t string) bool {
+			i := sort.SearchStrings(tags, t)
+			return i < len(tags) && tags[i] == t && set&(1<<i) != 0
+		}
+		if x.Eval(ok) {
+			return false
+		}
+	}
+	return true
+}
+
 func unpackRecur(depth uint32, t ast.Node) string {
 	if depth == 0 {
 		return ""
@@ -235,6 +566,10 @@ func unpackRecur(depth uint32, t ast.Node) string {
 		return unpackRecur(depth-1, t.X)
 	case *ast.ArrayType:
 		return unpackRecur(depth-1, t.Elt)
+	case *ast.IndexExpr: // instance of type with type parameters e.g. List[E]
+		return unpackRecur(depth-1, t.X)
+	case *ast.IndexListExpr:
+		return unpackRecur(depth-1, t.X)
 	default:
 		return ""
 	}
@@ -248,6 +583,10 @@ func unpackCtorRet(fd *ast.FuncDecl) string {
 	return ""
 }
 
+func goFileFilter(info os.FileInfo) bool {
+	return strings.HasSuffix(info.Name(), ".go")
+}
+
 func pkgFileFilter(info os.FileInfo) bool {
 	name := info.Name()
 	if strings.HasSuffix(name, "_test.go") || !strings.HasSuffix(name, ".go") {
@@ -256,33 +595,90 @@ func pkgFileFilter(info os.FileInfo) bool {
 	return true
 }
 
-func receiverType(fd *ast.FuncDecl) string {
+func receiverType(fd *ast.FuncDecl, l *log.Logger) string {
 	if fd.Recv == nil {
 		return ""
 	}
-	t := fd.Recv.List[0].Type
+	t := recvBaseType(fd.Recv.List[0].Type)
 	var name string
 	switch t := t.(type) {
 	case *ast.Ident:
 		name = t.Name
 	case *ast.StarExpr:
 		x := t.X
-		if id, ok := x.(*ast.Ident); ok {
+		if id, ok := recvBaseType(x).(*ast.Ident); ok {
 			name = id.Name
 		} else {
-			log.Printf("Unsupported star(*) receiver type: %v", reflect.TypeOf(x))
+			logf(l, "Unsupported star(*) receiver type: %v", reflect.TypeOf(x))
 			return ""
 		}
 	default:
-		log.Printf("Unsupported receiver type: %v", reflect.TypeOf(t))
+		logf(l, "Unsupported receiver type: %v", reflect.TypeOf(t))
 		return ""
 	}
 	return name
 }
 
+// recvBaseType strips type parameters of receiver type e.g. List[E] -> List
+func recvBaseType(t ast.Expr) ast.Expr {
+	switch x := t.(type) {
+	case *ast.IndexExpr:
+		return x.X
+	case *ast.IndexListExpr:
+		return x.X
+	}
+	return t
+}
+
+// resolveRecvTypeParams binds idents of receiver type parameters (e.g. E in func (l List[E]) ...) to the objects
+// of kind ast.Typ declared by *ast.Field, like go/parser does for type parameters of types and funcs.
+// Otherwise they would be unresolved and confused with the typevars or generic types of the same name.
+func resolveRecvTypeParams(fd *ast.FuncDecl) {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return
+	}
+	t := fd.Recv.List[0].Type
+	if st, ok := t.(*ast.StarExpr); ok {
+		t = st.X
+	}
+	var params []ast.Expr
+	switch x := t.(type) {
+	case *ast.IndexExpr:
+		params = []ast.Expr{x.Index}
+	case *ast.IndexListExpr:
+		params = x.Indices
+	}
+	objs := make(map[string]*ast.Object)
+	for _, p := range params {
+		if id, ok := p.(*ast.Ident); ok && id.Name != "_" {
+			obj := ast.NewObj(ast.Typ, id.Name)
+			obj.Decl = &ast.Field{Names: []*ast.Ident{id}}
+			objs[id.Name] = obj
+		}
+	}
+	if len(objs) == 0 {
+		return
+	}
+	ast.Inspect(fd, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj == nil {
+			id.Obj = objs[id.Name]
+		}
+		return true
+	})
+}
+
+// isTypeParam reports whether id refers to the type parameter (Go 1.18 generics) rather than to the package level type
+func isTypeParam(id *ast.Ident) bool {
+	if id.Obj == nil || id.Obj.Kind != ast.Typ {
+		return false
+	}
+	_, ok := id.Obj.Decl.(*ast.Field)
+	return ok
+}
+
 const commentPrefix string = "//typeinst:"
 
-func (td *TypeDesc) parseSpecialComment(text string) bool {
+func (td *TypeDesc) parseSpecialComment(text string, l *log.Logger) bool {
 	if strings.HasPrefix(text, commentPrefix) {
 		text = strings.TrimPrefix(text, commentPrefix)
 		args := strings.Fields(text)
@@ -294,10 +690,10 @@ func (td *TypeDesc) parseSpecialComment(text string) bool {
 				td.isTypevar = true
 				return true
 			default:
-				log.Printf("ignoring illegal '%s'-comment unknown verb: %s", commentPrefix, verb)
+				logf(l, "ignoring illegal '%s'-comment unknown verb: %s", commentPrefix, verb)
 			}
 		} else {
-			log.Printf("ignoring empty '%s'-comment", commentPrefix)
+			logf(l, "ignoring empty '%s'-comment", commentPrefix)
 		}
 	}
 	return false
@@ -305,10 +701,12 @@ func (td *TypeDesc) parseSpecialComment(text string) bool {
 
 func (pd *PkgDesc) detectCtors() {
 	ctors := []string{}
-	for fname, fd := range pd.funcs {
+	for _, fname := range pd.sortedFuncs() {
+		fd := pd.funcs[fname]
 		if r := unpackCtorRet(fd); r != "" {
-			if tdef, ok := pd.types[r]; ok {
-				tdef.addCtor(fd)
+			if tdef, ok := pd.types[r]; ok && !tdef.isTypevar && (tdef.spec == nil || !isEmptyInterface(tdef.spec.Type)) {
+				// funcs returning typevars are generic funcs, not ctors
+				tdef.addCtor(pd.fset, fd)
 				pd.ctors[fname] = tdef
 				pd.occCtors[fd.Name] = struct{}{}
 				ctors = append(ctors, fname)
@@ -322,41 +720,84 @@ func (pd *PkgDesc) detectCtors() {
 
 // Inst requests the creation of concrete type with given name and typeargs
 func (pd *PkgDesc) Inst(typName, instName string, typeArgs map[string]string) error {
-	t, ok := pd.types[typName]
+	t, ok := pd.typeOrFunc(typName)
 	if !ok {
 		return fmt.Errorf("Type %s not found in package %s", typName, pd.name)
 	}
-	for tv := range typeArgs {
+	if err := pd.bindTypevars(typeArgs); err != nil {
+		return err
+	}
+	b := pd.targs.of(typeArgs)
+	if _, has := t.inst[b]; has {
+		return fmt.Errorf("Type %s instantiated repeatedly with the same (type) arguments (%s) in package %s", typName, b.Key, pd.name)
+	}
+	return pd.addInst(t, b, instName)
+}
+
+// bindTypevars makes typevars of the types bound by typeArgs (non-strict mode), or checks that they are typevars (strict mode)
+func (pd *PkgDesc) bindTypevars(typeArgs map[string]string) error {
+	var errs ErrorList
+	for _, tv := range sortedKeys(typeArgs) {
 		if !pd.typevars.Contains(tv) {
 			if pd.isStrict {
-				return fmt.Errorf("strict mode: type %s cannot be a typevar in package  %s", tv, pd.name)
+				errs.Addf("strict mode: type %s cannot be a typevar in package  %s", tv, pd.name)
+				continue
 			}
 			t, ok := pd.types[tv]
 			if !ok {
-				return fmt.Errorf("type %s (a typevar) not found in package %s", tv, pd.name)
+				errs.Addf("type %s (a typevar) not found in package %s", tv, pd.name)
+				continue
 			}
 			if !t.canBeTypevar() {
-				return fmt.Errorf("type %s cannot be a typevar in package  %s", tv, pd.name)
+				errs.Addf("type %s cannot be a typevar in package  %s", tv, pd.name)
+				continue
 			}
 			pd.typevars.Add(tv)
 			t.isTypevar = true
 		}
 	}
-	b := TypeArgsOf(typeArgs)
-	if _, has := t.inst[b]; has {
-		return fmt.Errorf("Type %s instantiated repeatedly with the same (type) arguments (%s) in package %s", typName, b.Key, pd.name)
-	}
+	return errs.Err()
+}
+
+// addInst adds instance of generic type t, its typevars must be bound (see bindTypevars)
+func (pd *PkgDesc) addInst(t *TypeDesc, b *TypeArgs, instName string) error {
+	typName := t.name()
 	if shape := t.shape(); shape != nil && shape.Shape != b.Shape {
 		return fmt.Errorf("Type %s cannot be instantiated several times with inconsitent typevars (<%s> != <%s>) in package %s",
 			typName, b.Shape, shape.Shape, pd.name)
 	}
-	t.initBinds()
-	t.inst[b] = instName
+	t.addInst(b, instName)
 	pd.generic.Add(typName)
 	return nil
 }
 
-func (pd *PkgDesc) resolveRecur(td, parent *TypeDesc, visited StrSet) {
+// typeOrFunc returns type, or free standing func (as a "type" of its own, see funcUnit) if there is no such type
+func (pd *PkgDesc) typeOrFunc(name string) (*TypeDesc, bool) {
+	if t, ok := pd.types[name]; ok {
+		return t, true
+	}
+	return pd.funcUnit(name)
+}
+
+// funcUnit returns TypeDesc of free standing func, which makes generic func an instantiable unit (like ESGT with Apply method):
+// its typevars are found in its signature and body, and it is printed under the instance name.
+// Package scope has a single namespace for types and funcs, so the func is stored in types under its own name.
+func (pd *PkgDesc) funcUnit(name string) (*TypeDesc, bool) {
+	fd, ok := pd.funcs[name]
+	if !ok {
+		return nil, false
+	}
+	t := &TypeDesc{
+		// synthetic spec: AST is shared by Impls of the session, so it is never modified
+		spec:    &ast.TypeSpec{Name: &ast.Ident{NamePos: fd.Name.Pos(), Name: name}, Type: &ast.StructType{Fields: &ast.FieldList{}}},
+		methods: []*ast.FuncDecl{fd},
+		isFunc:  true,
+	}
+	pd.types[name] = t
+	return t, true
+}
+
+func (pd *PkgDesc) resolveRecur(td, parent *TypeDesc, visited sets.StrSet) {
 	if visited.Contains(td.name()) {
 		return
 	}
@@ -365,18 +806,29 @@ func (pd *PkgDesc) resolveRecur(td, parent *TypeDesc, visited StrSet) {
 	if parent == nil {
 		parent = td
 	}
-	depTypes := NewStrSet()
-	td.typevars = NewStrSet()
+	depTypes := sets.NewStrSet()
+	td.typevars = sets.NewStrSet()
+	td.foreign = nil
 	pd.walkType(td, func(params astWalkerParams) {
 		id := params.id
 		tn := id.Name
-		if t, ok := pd.types[tn]; ok {
-			if t != td {
-				if t.isTypevar {
-					td.typevars.Add(tn)
-				} else {
-					depTypes.Add(tn)
-				}
+		if params.kind == ast.Pkg {
+			if params.sel != nil {
+				pd.resolveForeign(td, params.sel)
+			}
+			return
+		}
+		t, ok := pd.types[tn]
+		if !ok && (params.kind == ast.Fun || params.kind == ast.Bad) {
+			if t, ok = pd.ctors[tn]; !ok {
+				t, ok = pd.funcUnit(tn)
+			}
+		}
+		if ok && t != td && t.spec != nil {
+			if t.isTypevar {
+				td.typevars.Add(tn)
+			} else {
+				depTypes.Add(t.name())
 			}
 		}
 	})
@@ -398,6 +850,134 @@ func (pd *PkgDesc) resolveRecur(td, parent *TypeDesc, visited StrSet) {
 	}
 }
 
+func (pd *PkgDesc) position(n ast.Node) token.Position {
+	return pd.fset.Position(n.Pos())
+}
+
+// sortedTypes returns declared types of the package in source order
+func (pd *PkgDesc) sortedTypes() []*TypeDesc {
+	types := make([]*TypeDesc, 0, len(pd.types))
+	for _, t := range pd.types {
+		if t.spec != nil {
+			types = append(types, t)
+		}
+	}
+	sortTypes(types)
+	return types
+}
+
+// typevarOrder returns typevars of the package in declaration order
+func (pd *PkgDesc) typevarOrder() []string {
+	return pd.declOrder(sortedStrs(pd.typevars))
+}
+
+// declOrder sorts type names in declaration order (by file name, then by position)
+func (pd *PkgDesc) declOrder(names []string) []string {
+	pos := func(i int) token.Position { return pd.position(pd.types[names[i]].spec) }
+	sort.SliceStable(names, func(i, j int) bool {
+		pi, pj := pos(i), pos(j)
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		return pi.Offset < pj.Offset
+	})
+	return names
+}
+
+// typevarsOf returns typevars which generic type t depends on, in declaration order.
+// Types are reached the same way as by resolveRecur (including ctors and generic funcs called by t), but unlike resolveRecur
+// it is called before instantiation, so unless typevars are marked by "typevar"-comment (strict mode),
+// the reached empty interfaces are considered typevars, along with already bound typevars.
+func (pd *PkgDesc) typevarsOf(t *TypeDesc) []string {
+	isTypevar := func(td *TypeDesc) bool {
+		if pd.isStrict {
+			return pd.typevars.Contains(td.name())
+		}
+		return td.isTypevar || isEmptyInterface(td.spec.Type)
+	}
+	found := sets.NewStrSet()
+	visited := sets.NewStrSet()
+	var visit func(td *TypeDesc)
+	visit = func(td *TypeDesc) {
+		if visited.Contains(td.name()) {
+			return
+		}
+		visited.Add(td.name())
+		pd.walkType(td, func(p astWalkerParams) {
+			if p.kind == ast.Pkg {
+				return
+			}
+			dep, ok := pd.types[p.id.Name]
+			if !ok && (p.kind == ast.Fun || p.kind == ast.Bad) {
+				if dep, ok = pd.ctors[p.id.Name]; !ok {
+					dep, ok = pd.funcUnit(p.id.Name)
+				}
+			}
+			if !ok || dep == td || dep.spec == nil {
+				return
+			}
+			if isTypevar(dep) {
+				found.Add(dep.name())
+			} else {
+				visit(dep)
+			}
+		})
+	}
+	visit(t)
+	return pd.declOrder(sortedStrs(found))
+}
+
+func isEmptyInterface(t ast.Expr) bool {
+	switch t := t.(type) {
+	case *ast.InterfaceType:
+		return t.Methods == nil || len(t.Methods.List) == 0
+	case *ast.Ident:
+		return t.Name == "any"
+	}
+	return false
+}
+
+// bindTypeArgs binds type arguments given by position (e.g. set.Set[string] in dsl-struct) to typevars of generic type
+func (pd *PkgDesc) bindTypeArgs(typName string, args []string) (map[string]string, error) {
+	t, ok := pd.typeOrFunc(typName)
+	if !ok || t.spec == nil {
+		return nil, fmt.Errorf("Type %s not found in package %s", typName, pd.name)
+	}
+	tvs := pd.typevarsOf(t)
+	if len(tvs) != len(args) {
+		return nil, fmt.Errorf("generic type %s has %d typevars (%s), but %d type arguments are given",
+			typName, len(tvs), strings.Join(tvs, ", "), len(args))
+	}
+	typeArgs := make(map[string]string)
+	for i, tv := range tvs {
+		typeArgs[tv] = args[i]
+	}
+	return typeArgs, nil
+}
+
+func sortTypes(types []*TypeDesc) {
+	sort.Slice(types, func(i, j int) bool { return types[i].spec.Pos() < types[j].spec.Pos() })
+}
+
+// sortedFuncs returns names of free standing funcs in source order
+func (pd *PkgDesc) sortedFuncs() []string {
+	names := make([]string, 0, len(pd.funcs))
+	for n := range pd.funcs {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return pd.funcs[names[i]].Pos() < pd.funcs[names[j]].Pos() })
+	return names
+}
+
+func sortedFiles(files map[string]*ast.File) []string {
+	names := make([]string, 0, len(files))
+	for fn := range files {
+		names = append(names, fn)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (td *TypeDesc) shape() *TypeArgs {
 	for any := range td.inst {
 		return any
@@ -411,31 +991,74 @@ func (pd *PkgDesc) resolveGeneric() error {
 		t, _ := pd.types[tn]
 		roots = append(roots, t)
 	}
+	sortTypes(roots)
 	for _, t := range roots {
-		pd.resolveRecur(t, nil, NewStrSet())
+		pd.resolveRecur(t, nil, sets.NewStrSet())
 	}
 
-	for tn := range pd.generic {
-		gent, _ := pd.types[tn]
+	var errs ErrorList
+	for _, t := range roots {
+		if t.isFunc && !t.isGeneric() && len(t.instOrder) != 0 {
+			errs.Add(errorfAt(pd.position(t.spec), "func %s is not generic (it does not depend on typevars), it cannot be instantiated as %s",
+				t.name(), t.inst[t.instOrder[0]]))
+		}
+	}
+	for _, gent := range pd.sortedTypes() {
+		if !pd.generic.Contains(gent.name()) {
+			continue
+		}
 		b := gent.shape()
-		for tv := range gent.typevars {
+		for _, tv := range sortedStrs(gent.typevars) {
 			if _, has := b.Binds[tv]; !has {
-				return fmt.Errorf("typevar %s is unbound for generic type %s in package %s", tv, tn, pd.name)
+				errs.Add(errorfAt(pd.position(gent.spec), "typevar %s is unbound for generic type %s in package %s", tv, gent.name(), pd.name))
 			}
 		}
 	}
+	if len(errs) != 0 {
+		return errs
+	}
 
-	for _, t := range pd.types {
+	for _, t := range pd.sortedTypes() {
 		if t.isGeneric() {
-			for ta, instName := range t.inst {
-				log.Printf("resolved: type %s = %s with args: %v ", instName, t.name(), ta.Binds)
+			for _, ta := range t.instOrder {
+				logf(pd.log, "resolved: type %s = %s with args: %v ", t.inst[ta], t.name(), ta.Binds)
 			}
 			pd.walkTypeMarkOcc(t)
 		}
 	}
+	if err := pd.instForeign(); err != nil {
+		return err
+	}
+	for _, tv := range sortedStrs(pd.typevars) {
+		if t := pd.types[tv]; t.constraint() != nil {
+			// typevar occurences in constraint are marked too, see Impl.checkConstraints
+			ast.Walk(astWalker(pd.markOccurences), t.spec.Type)
+		}
+	}
+	if pd.name != localPkgName {
+		// non-generic code of local generic types is declared in the package of dsl-struct itself
+		if err := pd.resolveNonGeneric(); err != nil {
+			return err
+		}
+	}
+	if len(pd.testFuncs) != 0 {
+		pd.resolveTests()
+	}
 	return nil
 }
 
+// constraint returns non-empty interface of typevar, or nil if typevar can be substituted by any type
+func (td *TypeDesc) constraint() *ast.InterfaceType {
+	if !td.isTypevar || td.spec == nil {
+		return nil
+	}
+	it, ok := td.spec.Type.(*ast.InterfaceType)
+	if !ok || it.Methods == nil || len(it.Methods.List) == 0 {
+		return nil
+	}
+	return it
+}
+
 func (pd *PkgDesc) markOccurences(p astWalkerParams) {
 	n := p.id.Name
 
@@ -456,6 +1079,23 @@ func (pd *PkgDesc) markOccurences(p astWalkerParams) {
 			pd.occCtors.Add(p.id)
 			return
 		}
+		if t, has := pd.types[n]; has && t.isFunc && pd.generic.Contains(n) {
+			pd.occTypes.Add(p.id)
+			return
+		}
+		if _, has := pd.testOwner[n]; has {
+			pd.occTests.Add(p.id)
+			return
+		}
+		if _, has := pd.testTypevars[n]; has {
+			pd.occTests.Add(p.id)
+			return
+		}
+	}
+	if p.kind == ast.Pkg && p.sel != nil && pd.deps[n] != nil {
+		// substituted by instance name at print time, see foreignName()
+		pd.occForeign[p.id] = p.sel
+		pd.occForeign[p.sel.Sel] = p.sel
 	}
 	if _, has := pd.impRename[n]; has {
 		pd.occPkgs.Add(p.id)
@@ -463,27 +1103,36 @@ func (pd *PkgDesc) markOccurences(p astWalkerParams) {
 }
 
 func (pd *PkgDesc) walkType(t *TypeDesc, vf func(astWalkerParams)) {
-	var reach astWalker = vf // "reachability" walker (it avoids body)
-
-	ast.Walk(reach, t.spec.Type)
+	var reach astWalker = vf // "reachability" walker, bodies are walked too e.g. helper type of local var
 
-	for _, f := range t.methods {
-		ast.Walk(reach, f.Type)
+	if t.spec.TypeParams != nil {
+		ast.Walk(reach, t.spec.TypeParams)
 	}
+	ast.Walk(reach, t.spec.Type)
 
-	for _, f := range t.ctors {
+	for _, f := range append(t.methods[:len(t.methods):len(t.methods)], t.ctors...) {
 		ast.Walk(reach, f.Type)
+		if f.Body != nil {
+			ast.Walk(reach, f.Body)
+		}
 	}
 }
 
 func (pd *PkgDesc) walkTypeMarkOcc(t *TypeDesc) {
 	var mark astWalker = pd.markOccurences
+	if t.spec.TypeParams != nil {
+		ast.Walk(mark, t.spec.TypeParams)
+	}
 	ast.Walk(mark, t.spec.Type)
 	pd.occTypes.Add(t.spec.Name)
 	for _, f := range t.methods {
 		ast.Walk(mark, f.Type)
-		ast.Walk(mark, f.Body)
-		ast.Walk(mark, f.Recv)
+		if f.Body != nil {
+			ast.Walk(mark, f.Body)
+		}
+		if f.Recv != nil {
+			ast.Walk(mark, f.Recv)
+		}
 	}
 	for _, f := range t.ctors {
 		ast.Walk(mark, f.Type)
@@ -493,7 +1142,8 @@ func (pd *PkgDesc) walkTypeMarkOcc(t *TypeDesc) {
 
 type astWalkerParams struct {
 	id   *ast.Ident
-	kind ast.ObjKind // Fun/Pkg/Typ
+	kind ast.ObjKind       // Fun/Pkg/Typ
+	sel  *ast.SelectorExpr // package member selector (for Pkg kind)
 }
 
 type astWalker func(params astWalkerParams)
@@ -504,20 +1154,25 @@ func (w astWalker) Visit(node ast.Node) ast.Visitor {
 	}
 	switch node := node.(type) {
 	case *ast.Ident:
+		if isTypeParam(node) {
+			return w
+		}
 		if node.Obj == nil {
-			w(astWalkerParams{node, ast.Bad})
+			w(astWalkerParams{id: node, kind: ast.Bad})
 		} else {
 			switch node.Obj.Kind {
 			case ast.Typ, ast.Fun, ast.Con:
-				w(astWalkerParams{node, node.Obj.Kind})
+				w(astWalkerParams{id: node, kind: node.Obj.Kind})
 			}
 		}
 	case *ast.SelectorExpr:
 		switch x := node.X.(type) {
 		case *ast.Ident:
 			if x.Obj == nil || x.Obj.Kind == ast.Pkg {
-				w(astWalkerParams{x, ast.Pkg})
+				w(astWalkerParams{id: x, kind: ast.Pkg, sel: node})
 			}
+		default:
+			ast.Walk(w, x) // operand may refer to generic types and ctors e.g. NewT().Method, see TestSelectorOperand
 		}
 		return nil
 	case *ast.ImportSpec: